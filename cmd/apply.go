@@ -1,11 +1,19 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/quasoft/pgmig/db"
+	"github.com/quasoft/pgmig/logger"
 	"github.com/quasoft/pgmig/mig"
+	"github.com/quasoft/pgmig/notify"
 
 	"github.com/spf13/cobra"
 )
@@ -13,10 +21,25 @@ import (
 var applySession = db.NewSession()
 var applyDir = mig.NewDir()
 var createChangelog bool
+var applyConfig string
+var applyTargetsFile string
+var applyTargetsQuery string
+var applyConcurrency int
+var applyTenantSchemas string
+var applySchemaFile string
+var applyRehearse bool
+var applyContexts []string
+var applyTimeout time.Duration
+var applySettings []string
+
+// applyInterrupted is the exit code of apply runs interrupted by a signal or the timeout
+const applyInterrupted = 3
 
 func init() {
 	applyCmd.Flags().SortFlags = false
-	applyCmd.Flags().StringVarP(&applyDir.Path, "dir", "D", "", "Local directory with migration scripts (default: current dir)")
+	addDirFlags(applyCmd, applyDir)
+	addMetricsFlags(applyCmd)
+	addNotifyFlags(applyCmd)
 	applyCmd.Flags().StringP("host", "", "localhost", "Hostname or IP address of PostgreSQL server")
 	applyCmd.Flags().StringP("port", "p", "5432", "The port of the DB instance")
 	applyCmd.Flags().StringP("database", "d", "localhost", "Hostname or IP address of PostgreSQL server")
@@ -24,13 +47,44 @@ func init() {
 	applyCmd.Flags().StringP("ssl-mode", "s", "disable", "SSL mode (disable | allow | prefer | require | verify-ca | validate-full)")
 	applyCmd.Flags().BoolVarP(&createChangelog, "create-changelog", "c", false, "Automatically create changelog table if it does not exist")
 	applyCmd.Flags().StringVarP(&applySession.ChangelogName, "changelog-name", "n", "changelog", "Name of table to write change logs to")
+	applyCmd.Flags().StringVar(&applySession.LockTimeout, "lock-timeout", "", "Maximum time to wait for a lock, eg. 5s (default: no limit)")
+	applyCmd.Flags().StringVar(&applySession.StatementTimeout, "statement-timeout", "", "Maximum time a migration may run, eg. 10min (default: no limit)")
+	applyCmd.Flags().IntVar(&applySession.Retries, "retries", 0, "Number of times to retry a transactional migration after a lock timeout")
+	applyCmd.Flags().DurationVar(&applySession.RetryDelay, "retry-delay", time.Second, "Delay before the first retry, doubled on each subsequent retry")
+	applyCmd.Flags().StringVar(&applySession.Role, "role", "", "Role to apply migrations as (SET ROLE), eg. the owner of the application objects (default: the connecting user)")
+	applyCmd.Flags().StringArrayVar(&applySettings, "set", nil, "Run-time parameter to set for each migration as name=value, eg. work_mem=256MB (can be repeated)")
+	applyCmd.Flags().StringSliceVar(&applyContexts, "context", nil, "Contexts (environments) to apply migrations for, eg. dev,ci; migrations of other contexts are recorded as skipped (default: all)")
+	applyCmd.Flags().DurationVar(&applyTimeout, "timeout", 0, "Maximum duration of the whole run, eg. 30m, after which the running migration is cancelled (default: no limit)")
+	applyCmd.Flags().BoolVar(&applyRehearse, "rehearse", false, "Run pending migrations in a single transaction and roll it back, reporting timing and locks")
+	applyCmd.Flags().StringVar(&applySchemaFile, "schema-file", "", "File to write a dump of the database schema to, after applying migrations")
+	applyCmd.Flags().StringVar(&applyConfig, "config", "", "JSON config file with a list of target databases and notification settings")
+	applyCmd.Flags().StringVar(&applyTargetsFile, "targets-file", "", "File listing target databases, one per line")
+	applyCmd.Flags().StringVar(&applyTargetsQuery, "targets-query", "", "Query returning target databases, run against the database given by the connection flags")
+	applyCmd.Flags().StringVar(&applyTenantSchemas, "tenant-schemas", "", "LIKE pattern for schemas to apply migrations to, one schema at a time (eg. tenant_%)")
+	applyCmd.Flags().IntVarP(&applyConcurrency, "concurrency", "j", 4, "Maximum number of target databases to migrate in parallel")
+	addConnectFlags(applyCmd, applySession)
 	applyCmd.Flags().BoolP("interactive", "i", true, "Ask for password if not provided in PGPASSWORD environment variable or the PGPASSFILE")
 	rootCmd.AddCommand(applyCmd)
 }
 
 var applyCmd = &cobra.Command{
-	Use:   "apply [--dir <path>] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--create-changelog <bool>] [--changelog-name <string>] [--interactive]",
+	Use:   "apply [--dir <path>] [--recursive] [--include-dir <glob>] [--exclude-dir <glob>] [--include <glob>] [--exclude <glob>] [--strict] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--create-changelog <bool>] [--changelog-name <string>] [--lock-timeout <interval>] [--statement-timeout <interval>] [--retries <int>] [--retry-delay <duration>] [--role <string>] [--set <name=value>] [--context <names>] [--timeout <duration>] [--rehearse] [--schema-file <path>] [--config <path>] [--targets-file <path>] [--targets-query <sql>] [--tenant-schemas <pattern>] [--concurrency <int>] [--metrics-file <path>] [--metrics-addr <addr>] [--notify-url <url>] [--notify-command <cmd>] [--notify-retries <int>] [--wait <duration>] [--connect-timeout <duration>] [--driver <name>] [--interactive]",
 	Short: "Applies migration SQL files from a directory to a specified PostgreSQL database",
+	Long: `Applies migration SQL files from a directory to a specified PostgreSQL database.
+
+Migrations can be applied to many databases at once by listing them in the "targets" section of
+a JSON config file (--config), in a file with one target per line (--targets-file) or by querying
+a catalog database (--targets-query). A target is either a database name on the server given by
+the connection flags or a list of connection parameters, eg.:
+
+  host=10.0.0.2 port=5433 dbname=customer_002 user=postgres sslmode=require
+
+With --tenant-schemas, migrations are applied to each schema matching the pattern in the database
+given by the connection flags. The schema is put first in the search_path while migrating it and
+gets its own changelog table, so newly created schemas are migrated from zero.
+
+In multi-target mode a summary is printed at the end and the exit code is 0 if all targets
+succeeded, 1 if all of them failed and 2 if only some of them failed.`,
 	Example: `  Apply pending migrations:
   pgmig apply
 
@@ -42,54 +96,549 @@ var applyCmd = &cobra.Command{
 
   Apply pending migrations and log to an existing changelog table:
   pgmig apply -n myproj_changelog
+
+  Give up waiting for locks after 5 seconds and retry up to 3 times:
+  pgmig apply --lock-timeout 5s --retries 3
+
+  Apply migrations as the owner of the application objects, with more memory for sorts:
+  pgmig apply --role app_owner --set work_mem=256MB --set maintenance_work_mem=1GB
+
+  Check that pending migrations succeed against real data, without making any changes:
+  pgmig apply --rehearse
+
+  Apply pending migrations and update the schema snapshot committed next to them:
+  pgmig apply -D ~/proj/db/migrations --schema-file ~/proj/db/schema.sql
+
+  Apply pending migrations to each database listed in a file, 10 databases at a time:
+  pgmig apply --targets-file customers.txt -j 10
+
+  Apply pending migrations to each customer database found on the server:
+  pgmig apply -d postgres --targets-query "SELECT datname FROM pg_database WHERE datname LIKE 'customer_%'"
+
+  Apply pending migrations to each tenant schema in a database:
+  pgmig apply -d saas --tenant-schemas 'tenant_%'
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		ParseFlagsOrEnv(applySession, cmd)
 
-		// Connect to DB
-		fmt.Printf("Connecting to %s:%s\n", applySession.Host, applySession.Port)
-		err := applySession.Connect()
+		var sessions []*db.Session
+		c := &config{}
+		var err error
+		if applyConfig != "" {
+			c, err = loadConfig(applyConfig)
+			if err != nil {
+				log.Error("Could not load config file", logger.Fields{"file": applyConfig}, errFields(err))
+				os.Exit(1)
+			}
+		}
+		err = sessionSettings(applySession, c)
+		if err != nil {
+			log.Error("Invalid session settings", errFields(err))
+			os.Exit(1)
+		}
+		targets, err := applyTargets(c)
+		// Never fall back to migrating the database given by the connection flags, which is
+		// eg. the catalog database of --targets-query
+		if err == nil && len(targets) == 0 && (applyTargetsFile != "" || applyTargetsQuery != "") {
+			err = errors.New("no targets found")
+		}
+		if err == nil {
+			sessions, err = targetSessions(applySession, targets)
+		}
+		if err == nil && applyTenantSchemas != "" {
+			log.Info("Looking for tenant schemas", logger.Fields{"target": targetName(applySession), "pattern": applyTenantSchemas})
+			var tenants []*db.Session
+			tenants, err = tenantSessions(applySession, applyTenantSchemas)
+			if err == nil && len(tenants) == 0 {
+				err = fmt.Errorf("no schemas match %s", applyTenantSchemas)
+			}
+			sessions = append(sessions, tenants...)
+		}
 		if err != nil {
-			fmt.Println("Error: " + err.Error())
+			log.Error("Could not find target databases", errFields(err))
 			os.Exit(1)
 		}
+
+		ctx, cancel := runContext(applyTimeout)
+		setupNotifiers(c)
+		startMetrics()
+		var code int
+		if len(sessions) == 0 {
+			code = applySingle(ctx, applySession, applyDir, applySchemaFile)
+		} else {
+			code = applyAll(ctx, applySession, sessions, applyDir, applyConcurrency)
+		}
+		finishMetrics(ctx)
+		cancel()
+		os.Exit(code)
+	},
+}
+
+// applySingle applies pending migrations to the database of the session and optionally dumps its
+// schema to a file. Returns the exit code for the process.
+func applySingle(ctx context.Context, s *db.Session, dir *mig.Dir, schemaFile string) int {
+	res := applyPending(ctx, s, dir, targetLog(s))
+	if res.Interrupted {
+		return applyInterrupted
+	}
+	if res.Err != nil {
+		return 1
+	}
+	if schemaFile != "" {
+		err := dumpAppliedSchema(s, schemaFile)
+		if err != nil {
+			log.Error("Could not write schema", errFields(err))
+			return 1
+		}
+		log.Info("Schema written", logger.Fields{"file": schemaFile})
+	}
+	return 0
+}
+
+// sessionSettings sets the role and run-time parameters of the session from the config file,
+// overridden by --role and --set
+func sessionSettings(s *db.Session, c *config) error {
+	if s.Role == "" {
+		s.Role = c.Role
+	}
+	settings := map[string]string{}
+	for name, value := range c.Settings {
+		settings[name] = value
+	}
+	for _, setting := range applySettings {
+		name, value, err := mig.ParseSetting(setting)
+		if err != nil {
+			return err
+		}
+		settings[name] = value
+	}
+	if len(settings) > 0 {
+		s.Settings = settings
+	}
+	return nil
+}
+
+// applyResult summarizes an apply run against a single database
+type applyResult struct {
+	Target  string
+	Applied int
+	// Migrations lists the applied migrations and the time it took to apply each of them
+	Migrations []notify.Migration
+	// FailedAt is the version of the migration that failed, if any
+	FailedAt int
+	// Interrupted is set if the run was stopped by a signal or the timeout
+	Interrupted bool
+	Err         error
+}
+
+func (r applyResult) String() string {
+	switch {
+	case r.Interrupted && r.FailedAt > 0:
+		return fmt.Sprintf("applied %d, interrupted at version %d", r.Applied, r.FailedAt)
+	case r.Interrupted:
+		return fmt.Sprintf("applied %d, interrupted", r.Applied)
+	case r.Err != nil && r.FailedAt > 0:
+		return fmt.Sprintf("applied %d, failed at version %d", r.Applied, r.FailedAt)
+	case r.Err != nil:
+		return "failed"
+	case r.Applied == 0:
+		return "up to date"
+	default:
+		return fmt.Sprintf("applied %d", r.Applied)
+	}
+}
+
+// applyTargets returns the databases to apply migrations to in multi-target mode, as listed in
+// the config file, the targets file and the result of the targets query
+func applyTargets(c *config) ([]string, error) {
+	targets := append([]string{}, c.Targets...)
+
+	if applyTargetsFile != "" {
+		t, err := readTargets(applyTargetsFile)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t...)
+	}
+
+	if applyTargetsQuery != "" {
+		log.Info("Connecting to catalog database", logger.Fields{"target": targetName(applySession)})
+		err := applySession.Connect()
+		if err != nil {
+			return nil, err
+		}
 		defer applySession.Disconnect()
 
-		// Create changelog table if it does not exist
-		if createChangelog {
-			err = applySession.EnsureChangelogExists()
-			if err != nil {
-				fmt.Printf("Error: changelog table does not exists and could not be created: %s\n", err)
-				applySession.Disconnect()
-				os.Exit(1)
+		t, err := applySession.QueryColumn(applyTargetsQuery)
+		if err != nil {
+			return nil, fmt.Errorf("could not query targets from catalog database: %v", err)
+		}
+		targets = append(targets, t...)
+	}
+
+	return targets, nil
+}
+
+// applyAll applies pending migrations to each of the target sessions, running up to concurrency
+// targets in parallel, and logs a summary. Returns the exit code for the process:
+// 0 if all targets succeeded, 1 if all failed, 2 if only some of them failed and
+// applyInterrupted if the run was interrupted. Targets are not started after an interruption.
+func applyAll(ctx context.Context, base *db.Session, sessions []*db.Session, dir *mig.Dir, concurrency int) int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// Ask for the password once, instead of for each target
+	base.ResolvePassword()
+	for _, s := range sessions {
+		if s.Password == "" {
+			s.Password = base.Password
+		}
+	}
+
+	results := make([]applyResult, len(sessions))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				s := sessions[i]
+				if ctx.Err() != nil {
+					results[i] = applyResult{Target: targetName(s), Interrupted: true, Err: ctx.Err()}
+					continue
+				}
+				// Each target needs its own copy, as scanning the directory records warnings in it
+				d := *dir
+				results[i] = applyPending(ctx, s, &d, targetLog(s))
 			}
+		}()
+	}
+	for i := range sessions {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		fields := logger.Fields{"target": r.Target, "applied": r.Applied, "result": r.String()}
+		if r.Err != nil {
+			failed++
+			if r.FailedAt > 0 {
+				fields["version"] = r.FailedAt
+			}
+			log.Error("Target failed", fields, errFields(r.Err))
+		} else {
+			log.Info("Target succeeded", fields)
 		}
+	}
+	log.Info("Summary", logger.Fields{"targets": len(results), "succeeded": len(results) - failed, "failed": failed})
+
+	switch {
+	case ctx.Err() != nil:
+		return applyInterrupted
+	case failed == 0:
+		return 0
+	case failed == len(results):
+		return 1
+	default:
+		return 2
+	}
+}
 
-		// Scan specified directory for migration files that have not been applied (with ID > lastID)
-		migrations, err := applySession.PendingMigrations(applyDir)
+// applyPending applies pending migrations from the directory to the database of the session,
+// running hooks at the matching points. Events are logged with the given logger. If the context
+// is cancelled, the running migration is cancelled and rolled back, and no further migrations are applied.
+func applyPending(ctx context.Context, s *db.Session, dir *mig.Dir, l *logger.Logger) applyResult {
+	res := applyResult{Target: targetName(s)}
+
+	// Connect to DB
+	l.Info("Connecting")
+	s.OnConnectRetry = connectRetryLogger(l)
+	s.OnNotice = noticeLogger(l)
+	err := s.ConnectContext(ctx)
+	if err != nil {
+		l.Error("Could not connect", errFields(err))
+		recordApplyError(s)
+		res.Err = err
+		sendNotification(l, notify.Failure, res, nil)
+		return res
+	}
+	defer s.Disconnect()
+
+	if applyRehearse {
+		return rehearsePending(ctx, s, dir, l)
+	}
+	s.OnBatch = batchLogger(l)
+
+	// All error paths below set res.Err before returning
+	defer func() {
+		if res.Err != nil {
+			recordApplyError(s)
+			sendNotification(l, notify.Failure, res, nil)
+		}
+		recordDatabaseStatus(s, dir, l)
+	}()
+
+	// Create changelog table if it does not exist. Tenant schemas always get their own changelog table,
+	// so that new schemas are migrated from zero.
+	if createChangelog || s.Schema != "" {
+		err = s.EnsureChangelogExists()
 		if err != nil {
-			fmt.Println("Error: " + err.Error())
-			applySession.Disconnect()
-			os.Exit(1)
+			l.Error("Changelog table does not exist and could not be created", errFields(err))
+			res.Err = err
+			return res
+		}
+	} else {
+		err = s.UpgradeChangelog()
+		if err != nil {
+			l.Error("Could not upgrade changelog table", errFields(err))
+			res.Err = err
+			return res
 		}
+	}
 
-		if len(migrations) == 0 {
-			fmt.Println("There are no pending migrations to apply.")
-			applySession.Disconnect()
-			os.Exit(0)
+	// Scan specified directory for migration files that have not been applied (with ID > lastID)
+	migrations, err := s.PendingMigrations(dir)
+	logDirWarnings(l, dir)
+	if err != nil {
+		l.Error("Could not find pending migrations", errFields(err))
+		res.Err = err
+		return res
+	}
+
+	hooks, err := dir.Hooks()
+	if err != nil {
+		l.Error("Could not find hooks", errFields(err))
+		res.Err = err
+		return res
+	}
+
+	// Runs the afterError hook and returns the result. Hooks are not run after an interruption.
+	fail := func(m *mig.File, err error) applyResult {
+		fields := errFields(err)
+		if m != nil {
+			fields["version"] = m.Ver
+			fields["file"] = m.RelPath
+			res.FailedAt = m.Ver
+		}
+		res.Err = err
+		if ctx.Err() != nil {
+			res.Interrupted = true
+			l.Warn("Apply interrupted", fields)
+			return res
 		}
+		l.Error("Apply failed", fields)
+		hookErr := runHook(ctx, s, hooks, mig.AfterError, m, err, l)
+		if hookErr != nil {
+			l.Error("Hook failed", logger.Fields{"hook": mig.AfterError}, errFields(hookErr))
+		}
+		return res
+	}
+
+	if len(migrations) > 0 {
+		sendNotification(l, notify.Start, res, inContexts(migrations, applyContexts))
+	}
 
-		// Apply each file sequentially
-		for _, m := range migrations {
-			fmt.Printf("Applying migration #%d from file %s.\r\n", m.Ver, m.FileName)
-			err := applySession.Apply(m)
+	err = runHook(ctx, s, hooks, mig.BeforeAll, nil, nil, l)
+	if err != nil {
+		return fail(nil, err)
+	}
+
+	if len(migrations) == 0 {
+		l.Info("There are no pending migrations to apply")
+		err = runHook(ctx, s, hooks, mig.AfterAll, nil, nil, l)
+		if err != nil {
+			return fail(nil, err)
+		}
+		return res
+	}
+
+	// Apply each file sequentially
+	for i := range migrations {
+		m := &migrations[i]
+		// Stop before the next migration, if interrupted
+		if ctx.Err() != nil {
+			return fail(m, ctx.Err())
+		}
+		if !m.InContexts(applyContexts) {
+			err = s.Skip(*m)
 			if err != nil {
-				fmt.Println("Error: " + err.Error())
-				applySession.Disconnect()
-				os.Exit(1)
+				return fail(m, err)
 			}
-			fmt.Printf("Migration #%d applied successfully.\r\n", m.Ver)
+			l.Info("Migration skipped, as it belongs to other contexts", logger.Fields{"version": m.Ver, "file": m.RelPath, "contexts": strings.Join(m.Contexts, ",")})
+			continue
 		}
-		fmt.Printf("Successfully applied %d migrations.\r\n", len(migrations))
-	},
+		err = runHook(ctx, s, hooks, mig.BeforeEach, m, nil, l)
+		if err != nil {
+			return fail(m, err)
+		}
+		fields := logger.Fields{"version": m.Ver, "file": m.RelPath}
+		l.Info("Applying migration", fields)
+		start := time.Now()
+		err = s.ApplyContext(ctx, *m)
+		if err != nil {
+			return fail(m, err)
+		}
+		duration := time.Since(start)
+		l.Info("Migration applied", fields, logger.Fields{"duration": duration})
+		recordDuration(s, m, duration)
+		res.Applied++
+		res.Migrations = append(res.Migrations, notify.Migration{Version: m.Ver, File: m.RelPath, DurationMs: int64(duration / time.Millisecond)})
+		err = runHook(ctx, s, hooks, mig.AfterEach, m, nil, l)
+		if err != nil {
+			return fail(m, err)
+		}
+	}
+
+	err = runHook(ctx, s, hooks, mig.AfterAll, nil, nil, l)
+	if err != nil {
+		return fail(nil, err)
+	}
+	l.Info("Successfully applied migrations", logger.Fields{"applied": res.Applied, "skipped": len(migrations) - res.Applied})
+	sendNotification(l, notify.Success, res, nil)
+	return res
+}
+
+// rehearsePending runs the pending migrations in a transaction, which is rolled back, and logs
+// the success, timing and locks taken for each of them
+func rehearsePending(ctx context.Context, s *db.Session, dir *mig.Dir, l *logger.Logger) applyResult {
+	res := applyResult{Target: targetName(s)}
+
+	// Without a changelog table all migrations are pending
+	exists, err := s.ChangelogExists()
+	var migrations []mig.File
+	if err == nil && exists {
+		migrations, err = s.PendingMigrations(dir)
+	} else if err == nil {
+		migrations, err = dir.Migrations()
+	}
+	logDirWarnings(l, dir)
+	if err != nil {
+		l.Error("Could not find pending migrations", errFields(err))
+		res.Err = err
+		return res
+	}
+
+	for _, m := range migrations {
+		if !m.InContexts(applyContexts) {
+			l.Info("Migration not rehearsed, as it belongs to other contexts", logger.Fields{"version": m.Ver, "file": m.RelPath, "contexts": strings.Join(m.Contexts, ",")})
+		}
+	}
+	migrations = inContexts(migrations, applyContexts)
+
+	if len(migrations) == 0 {
+		l.Info("There are no pending migrations to rehearse")
+		return res
+	}
+
+	l.Info("Rehearsing migrations", logger.Fields{"pending": len(migrations)})
+	results, err := s.RehearseContext(ctx, migrations)
+	for _, r := range results {
+		fields := logger.Fields{"version": r.File.Ver, "file": r.File.RelPath, "duration": r.Duration}
+		if len(r.Locks) > 0 {
+			fields["locks"] = strings.Join(r.Locks, ", ")
+		}
+		switch {
+		case r.Skipped:
+			l.Warn("Migration not rehearsable, as it cannot run in a transaction", logger.Fields{"version": r.File.Ver, "file": r.File.RelPath})
+		case r.Err != nil:
+			l.Error("Migration failed", fields, errFields(r.Err))
+			res.FailedAt = r.File.Ver
+			res.Err = r.Err
+		default:
+			l.Info("Migration succeeded", fields)
+			res.Applied++
+		}
+	}
+	for _, m := range migrations[len(results):] {
+		l.Warn("Migration not run", logger.Fields{"version": m.Ver, "file": m.RelPath})
+	}
+	if err != nil {
+		l.Error("Rehearsal failed", errFields(err))
+		res.Err = err
+	}
+	res.Interrupted = ctx.Err() != nil
+	l.Info("Rolled back, no changes were made")
+	return res
+}
+
+// batchProgressInterval is the minimum time between progress reports of batched migrations
+const batchProgressInterval = 10 * time.Second
+
+// batchLogger returns a callback, which logs the progress of batched migrations at most once per
+// batchProgressInterval, and when they complete
+func batchLogger(l *logger.Logger) func(db.BatchProgress) {
+	var last time.Time
+	return func(p db.BatchProgress) {
+		if !p.Done && time.Since(last) < batchProgressInterval {
+			return
+		}
+		last = time.Now()
+		fields := logger.Fields{
+			"version":      p.Ver,
+			"batches":      p.Batches,
+			"rows":         p.Rows,
+			"rows_per_sec": int64(p.RowsPerSec),
+			"duration":     p.Elapsed.Round(time.Second),
+		}
+		if p.Total > 0 {
+			fields["total"] = p.Total
+		}
+		if p.ETA > 0 {
+			fields["eta"] = p.ETA.Round(time.Second)
+		}
+		if p.Done {
+			l.Info("Batched migration completed", fields)
+		} else {
+			l.Info("Batched migration in progress", fields)
+		}
+	}
+}
+
+// inContexts returns the migrations to apply when the given contexts are selected
+func inContexts(migrations []mig.File, contexts []string) []mig.File {
+	var result []mig.File
+	for _, m := range migrations {
+		if m.InContexts(contexts) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// dumpAppliedSchema writes the schema of the database to a file after migrations were applied
+func dumpAppliedSchema(s *db.Session, path string) error {
+	err := s.Connect()
+	if err != nil {
+		return err
+	}
+	defer s.Disconnect()
+	return dumpSchema(s, path)
+}
+
+// runHook executes the hook with the given name, if it exists in the migrations directory.
+// The version, title and file of the current migration and the error (for the afterError hook)
+// are passed to the hook as variables.
+func runHook(ctx context.Context, s *db.Session, hooks map[string]string, name string, m *mig.File, migErr error, l *logger.Logger) error {
+	path, ok := hooks[name]
+	if !ok {
+		return nil
+	}
+
+	vars := map[string]string{}
+	fields := logger.Fields{"hook": name}
+	if m != nil {
+		vars["version"] = strconv.Itoa(m.Ver)
+		vars["title"] = m.Title
+		vars["file"] = m.RelPath
+		fields["version"] = m.Ver
+	}
+	if migErr != nil {
+		vars["error"] = migErr.Error()
+	}
+
+	l.Info("Running hook", fields)
+	return s.RunHookContext(ctx, path, vars)
 }
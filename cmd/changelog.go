@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/quasoft/pgmig/db"
+	"github.com/quasoft/pgmig/logger"
+	"github.com/quasoft/pgmig/mig"
+
+	"github.com/spf13/cobra"
+)
+
+var exportSession = db.NewSession()
+var exportFormat string
+var exportOutput string
+
+var restoreSession = db.NewSession()
+var restoreDir = mig.NewDir()
+var restoreFormat string
+var restoreFile string
+var restoreForce bool
+
+func init() {
+	changelogExportCmd.Flags().SortFlags = false
+	changelogExportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "File to write the changelog to (default: standard output)")
+	changelogExportCmd.Flags().StringVar(&exportFormat, "format", "", "Format of the file (json | csv) (default: by the extension of --output, or json)")
+	changelogExportCmd.Flags().StringP("host", "", "localhost", "Hostname or IP address of PostgreSQL server")
+	changelogExportCmd.Flags().StringP("port", "p", "5432", "The port of the DB instance")
+	changelogExportCmd.Flags().StringP("database", "d", "localhost", "Hostname or IP address of PostgreSQL server")
+	changelogExportCmd.Flags().StringP("username", "U", "", "The username of a superuser")
+	changelogExportCmd.Flags().StringP("ssl-mode", "s", "disable", "SSL mode (disable | allow | prefer | require | verify-ca | validate-full)")
+	changelogExportCmd.Flags().StringVarP(&exportSession.ChangelogName, "changelog-name", "n", "changelog", "Name of table to read change logs from")
+	addConnectFlags(changelogExportCmd, exportSession)
+	changelogExportCmd.Flags().BoolP("interactive", "i", true, "Ask for password if not provided in PGPASSWORD environment variable or the PGPASSFILE")
+
+	changelogImportCmd.Flags().SortFlags = false
+	changelogImportCmd.Flags().StringVarP(&restoreFile, "file", "f", "", "File to read the changelog from")
+	changelogImportCmd.Flags().StringVar(&restoreFormat, "format", "", "Format of the file (json | csv) (default: by the extension of --file)")
+	changelogImportCmd.Flags().BoolVar(&restoreForce, "force", false, "Replace migrations already in the changelog")
+	addDirFlags(changelogImportCmd, restoreDir)
+	changelogImportCmd.Flags().StringP("host", "", "localhost", "Hostname or IP address of PostgreSQL server")
+	changelogImportCmd.Flags().StringP("port", "p", "5432", "The port of the DB instance")
+	changelogImportCmd.Flags().StringP("database", "d", "localhost", "Hostname or IP address of PostgreSQL server")
+	changelogImportCmd.Flags().StringP("username", "U", "", "The username of a superuser")
+	changelogImportCmd.Flags().StringP("ssl-mode", "s", "disable", "SSL mode (disable | allow | prefer | require | verify-ca | validate-full)")
+	changelogImportCmd.Flags().StringVarP(&restoreSession.ChangelogName, "changelog-name", "n", "changelog", "Name of table to write change logs to")
+	addConnectFlags(changelogImportCmd, restoreSession)
+	changelogImportCmd.Flags().BoolP("interactive", "i", true, "Ask for password if not provided in PGPASSWORD environment variable or the PGPASSFILE")
+	changelogImportCmd.MarkFlagRequired("file")
+
+	changelogCmd.AddCommand(changelogExportCmd)
+	changelogCmd.AddCommand(changelogImportCmd)
+	rootCmd.AddCommand(changelogCmd)
+}
+
+var changelogCmd = &cobra.Command{
+	Use:   "changelog",
+	Short: "Export and import the changelog table",
+}
+
+var changelogExportCmd = &cobra.Command{
+	Use:   "export [--output <path>] [--format <string>] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--changelog-name <string>] [--wait <duration>] [--connect-timeout <duration>] [--driver <name>] [--interactive]",
+	Short: "Export all rows of the changelog table, including failed migrations, as JSON or CSV",
+	Example: `  Export the changelog for an audit:
+  pgmig changelog export -d testdb -o changelog.csv
+
+  Export the changelog to plan the next deployment offline:
+  pgmig changelog export -d testdb -o changelog.json
+  pgmig -D ~/proj/db/migrations --changelog-file changelog.json
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ParseFlagsOrEnv(exportSession, cmd)
+		l := targetLog(exportSession)
+
+		format, err := db.ParseFormat(exportFormat, exportOutput)
+		if err != nil {
+			l.Error("Invalid --format", errFields(err))
+			os.Exit(1)
+		}
+
+		// Connect to DB
+		l.Info("Connecting")
+		err = exportSession.Connect()
+		if err != nil {
+			l.Error("Could not connect", errFields(err))
+			os.Exit(1)
+		}
+		defer exportSession.Disconnect()
+
+		entries, err := exportSession.Changelog()
+		if err != nil {
+			l.Error("Could not read changelog", errFields(err))
+			exportSession.Disconnect()
+			os.Exit(1)
+		}
+
+		var w io.Writer = os.Stdout
+		if exportOutput != "" && exportOutput != "-" {
+			f, err := os.Create(exportOutput)
+			if err != nil {
+				l.Error("Could not create output file", errFields(err))
+				exportSession.Disconnect()
+				os.Exit(1)
+			}
+			defer f.Close()
+			w = f
+		}
+		err = db.WriteEntries(w, entries, format)
+		if err != nil {
+			l.Error("Could not write changelog", errFields(err))
+			exportSession.Disconnect()
+			os.Exit(1)
+		}
+		l.Info("Exported changelog", logger.Fields{"entries": len(entries), "format": format})
+	},
+}
+
+var changelogImportCmd = &cobra.Command{
+	Use:   "import --file <path> [--format <string>] [--force] [--dir <path>] [--recursive] [--include-dir <glob>] [--exclude-dir <glob>] [--include <glob>] [--exclude <glob>] [--strict] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--changelog-name <string>] [--wait <duration>] [--connect-timeout <duration>] [--driver <name>] [--interactive]",
+	Short: "Import a changelog exported with 'changelog export', eg. after restoring data into a new cluster",
+	Long: `Import a changelog exported with 'changelog export', eg. after restoring data into a new cluster.
+
+Each entry must match a migration file in the directory with the same version and file name,
+or be replaced by a baseline migration. If any entry is invalid, nothing is imported.
+The changelog table is created if it does not exist. Migrations already in the changelog are
+only replaced with --force. Entries are checked and imported in a single transaction.`,
+	Example: `  Restore the changelog after restoring data into a new database:
+  pgmig changelog import -f changelog.json -D ~/proj/db/migrations -d testdb
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ParseFlagsOrEnv(restoreSession, cmd)
+		l := targetLog(restoreSession)
+
+		format, err := db.ParseFormat(restoreFormat, restoreFile)
+		if err != nil {
+			l.Error("Invalid --format", errFields(err))
+			os.Exit(1)
+		}
+		entries, err := readChangelogFile(restoreFile, format)
+		if err != nil {
+			l.Error("Could not read changelog file", errFields(err))
+			os.Exit(1)
+		}
+
+		migrations, err := restoreDir.Migrations()
+		logDirWarnings(l, restoreDir)
+		if err != nil {
+			l.Error("Could not find migrations", errFields(err))
+			os.Exit(1)
+		}
+		errs := db.ValidateEntries(entries, migrations)
+		for _, err := range errs {
+			l.Error("Invalid changelog entry", errFields(err))
+		}
+		if len(errs) > 0 {
+			l.Error("Changelog does not match the migration files, nothing imported", logger.Fields{"invalid": len(errs)})
+			os.Exit(1)
+		}
+
+		// Connect to DB
+		l.Info("Connecting")
+		err = restoreSession.Connect()
+		if err != nil {
+			l.Error("Could not connect", errFields(err))
+			os.Exit(1)
+		}
+		defer restoreSession.Disconnect()
+
+		err = restoreSession.EnsureChangelogExists()
+		if err != nil {
+			l.Error("Changelog table does not exist and could not be created", errFields(err))
+			restoreSession.Disconnect()
+			os.Exit(1)
+		}
+		onConflict := db.FailOnConflict
+		if restoreForce {
+			onConflict = db.ReplaceOnConflict
+		}
+		conflicts, err := restoreSession.ImportEntries(entries, onConflict)
+		if len(conflicts) > 0 && !restoreForce {
+			files := map[int]string{}
+			for _, e := range entries {
+				files[e.Version] = e.FileName
+			}
+			for _, ver := range conflicts {
+				l.Error("Migration already in changelog", logger.Fields{"version": ver, "file": files[ver]})
+			}
+			l.Error("Changelog is not empty, nothing imported; use --force to replace existing migrations", logger.Fields{"conflicts": len(conflicts)})
+			restoreSession.Disconnect()
+			os.Exit(1)
+		}
+		if err != nil {
+			l.Error("Could not import changelog, nothing imported", errFields(err))
+			restoreSession.Disconnect()
+			os.Exit(1)
+		}
+		l.Info("Imported changelog", logger.Fields{"entries": len(entries), "replaced": len(conflicts)})
+	},
+}
+
+// readChangelogFile reads the changelog entries from the file at path
+func readChangelogFile(path string, format db.Format) ([]db.Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return db.ReadEntries(f, format)
+}
@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/quasoft/pgmig/db"
+	"github.com/quasoft/pgmig/logger"
+	"github.com/quasoft/pgmig/mig"
+
+	"github.com/spf13/cobra"
+)
+
+// Exit codes of the check command
+const (
+	checkUpToDate = 0
+	checkError    = 1
+	checkPending  = 2
+	checkFailed   = 3
+	checkDrift    = 4
+	checkAhead    = 5
+	checkNoConn   = 6
+)
+
+var checkSession = db.NewSession()
+var checkDir = mig.NewDir()
+var checkJUnit string
+
+func init() {
+	checkCmd.Flags().SortFlags = false
+	addDirFlags(checkCmd, checkDir)
+	addMetricsFlags(checkCmd)
+	checkCmd.Flags().StringVar(&checkJUnit, "junit", "", "File to write a JUnit XML report to, with a test case for each migration")
+	checkCmd.Flags().StringP("host", "", "localhost", "Hostname or IP address of PostgreSQL server")
+	checkCmd.Flags().StringP("port", "p", "5432", "The port of the DB instance")
+	checkCmd.Flags().StringP("database", "d", "localhost", "Hostname or IP address of PostgreSQL server")
+	checkCmd.Flags().StringP("username", "U", "", "The username of a superuser")
+	checkCmd.Flags().StringP("ssl-mode", "s", "disable", "SSL mode (disable | allow | prefer | require | verify-ca | validate-full)")
+	checkCmd.Flags().StringVarP(&checkSession.ChangelogName, "changelog-name", "n", "changelog", "Name of table to write change logs to")
+	addConnectFlags(checkCmd, checkSession)
+	checkCmd.Flags().BoolP("interactive", "i", true, "Ask for password if not provided in PGPASSWORD environment variable or the PGPASSFILE")
+	rootCmd.AddCommand(checkCmd)
+}
+
+var checkCmd = &cobra.Command{
+	Use:   "check [--dir <path>] [--junit <path>] [--metrics-file <path>] [--metrics-addr <addr>] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--changelog-name <string>] [--wait <duration>] [--connect-timeout <duration>] [--driver <name>] [--interactive]",
+	Short: "Checks if the database is up to date with the migration files, exiting with a status for CI pipelines",
+	Long: `Checks if the database is up to date with the migration files, exiting with a status for CI pipelines.
+
+Exit status:
+  0  the database is up to date
+  1  the check could not be completed
+  2  there are pending migrations
+  3  there are failed or interrupted migrations
+  4  drift was detected: an applied migration file is missing or was renamed, or a migration
+     older than the last applied one was never applied
+  5  the database is ahead of the code: it has migrations newer than all migration files
+  6  could not connect to the database
+
+If several problems are found, the status of the first one in the order failed, drift, ahead,
+pending is used.`,
+	Example: `  Fail a deployment pipeline if migrations are pending and write a JUnit report:
+  pgmig check -D ~/proj/db/migrations --host 10.0.0.1 -d testdb -U postgres --junit report.xml
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ParseFlagsOrEnv(checkSession, cmd)
+		startMetrics()
+		code := check(checkSession, checkDir, checkJUnit)
+		// Signals are only handled while serving metrics, so that the check itself can be interrupted
+		finishMetrics(context.Background())
+		os.Exit(code)
+	},
+}
+
+// check compares the changelog of the database with the migration files, logs the problems found,
+// optionally writes a JUnit report and returns the exit code of the check command
+func check(s *db.Session, dir *mig.Dir, junitPath string) int {
+	l := targetLog(s)
+
+	// Connect to DB
+	l.Info("Connecting")
+	err := s.Connect()
+	if err != nil {
+		l.Error("Could not connect", errFields(err))
+		writeCheckReport(l, junitPath, s, nil, err)
+		return checkNoConn
+	}
+	defer s.Disconnect()
+
+	statuses, err := s.Status(dir)
+	logDirWarnings(l, dir)
+	if err != nil {
+		l.Error("Could not check migrations", errFields(err))
+		writeCheckReport(l, junitPath, s, nil, err)
+		return checkError
+	}
+
+	recordStatus(s, statuses)
+	counts := map[db.State]int{}
+	for _, st := range statuses {
+		counts[st.State]++
+		fields := logger.Fields{"version": st.Ver, "file": st.File, "state": st.State}
+		if st.Reason != "" {
+			fields["reason"] = st.Reason
+		}
+		if len(st.Contexts) > 0 {
+			fields["contexts"] = strings.Join(st.Contexts, ",")
+		}
+		switch st.State {
+		case db.StateApplied:
+			l.Debug("Migration applied", fields)
+		case db.StateSkipped:
+			l.Debug("Migration skipped", fields)
+		case db.StatePending:
+			l.Warn("Migration pending", fields)
+		default:
+			l.Error("Migration "+string(st.State), fields)
+		}
+	}
+	l.Info("Checked migrations", logger.Fields{
+		"applied": counts[db.StateApplied],
+		"skipped": counts[db.StateSkipped],
+		"pending": counts[db.StatePending],
+		"failed":  counts[db.StateFailed] + counts[db.StateInterrupted],
+		"drift":   counts[db.StateDrift],
+		"ahead":   counts[db.StateAhead],
+	})
+
+	if !writeCheckReport(l, junitPath, s, statuses, nil) {
+		return checkError
+	}
+
+	switch {
+	case counts[db.StateFailed] > 0 || counts[db.StateInterrupted] > 0:
+		return checkFailed
+	case counts[db.StateDrift] > 0:
+		return checkDrift
+	case counts[db.StateAhead] > 0:
+		return checkAhead
+	case counts[db.StatePending] > 0:
+		return checkPending
+	default:
+		return checkUpToDate
+	}
+}
+
+// junitSuite is the root element of a JUnit XML report
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitReport builds a JUnit report with a test case for each migration. Pending migrations are
+// reported as skipped and failed, drifted and ahead migrations as failures. If the check could not
+// be completed, the report has a single test case with the error.
+func junitReport(target string, statuses []db.Status, checkErr error) junitSuite {
+	suite := junitSuite{Name: target}
+	if checkErr != nil {
+		suite.Cases = append(suite.Cases, junitCase{
+			Name:      "check",
+			ClassName: target,
+			Error:     &junitMessage{Message: checkErr.Error()},
+		})
+		suite.Tests, suite.Errors = 1, 1
+		return suite
+	}
+
+	for _, st := range statuses {
+		c := junitCase{Name: fmt.Sprintf("#%d %s", st.Ver, st.File), ClassName: target}
+		switch st.State {
+		case db.StateApplied, db.StateSkipped:
+		case db.StatePending:
+			c.Skipped = &junitMessage{Message: "pending"}
+			suite.Skipped++
+		default:
+			c.Failure = &junitMessage{Message: string(st.State), Text: st.Reason}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	suite.Tests = len(suite.Cases)
+	return suite
+}
+
+// writeCheckReport writes the JUnit report to the file at the given path, if not empty.
+// Returns false if the report could not be written.
+func writeCheckReport(l *logger.Logger, path string, s *db.Session, statuses []db.Status, checkErr error) bool {
+	if path == "" {
+		return true
+	}
+	out, err := xml.MarshalIndent(junitReport(targetName(s), statuses, checkErr), "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(path, append([]byte(xml.Header), append(out, '\n')...), 0644)
+	}
+	if err != nil {
+		l.Error("Could not write JUnit report", logger.Fields{"file": path}, errFields(err))
+		return false
+	}
+	l.Info("JUnit report written", logger.Fields{"file": path})
+	return true
+}
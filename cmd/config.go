@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// config holds the settings read from the file given with --config
+type config struct {
+	// Targets lists the databases to apply migrations to (see targetSession)
+	Targets []string `json:"targets"`
+	// Notify lists the webhooks and commands to notify about apply results
+	Notify notifyConfig `json:"notify"`
+	// Role is the role to apply migrations as (see --role)
+	Role string `json:"role"`
+	// Settings are run-time parameters to set for each migration (see --set)
+	Settings map[string]string `json:"settings"`
+}
+
+// notifyConfig holds the notification settings of the config file
+type notifyConfig struct {
+	URLs     []string `json:"urls"`
+	Commands []string `json:"commands"`
+}
+
+// loadConfig reads the JSON config file at the given path
+func loadConfig(path string) (*config, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file %s: %v", path, err)
+	}
+	var c config
+	err = json.Unmarshal(bytes, &c)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+	return &c, nil
+}
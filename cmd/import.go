@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/quasoft/pgmig/db"
+	"github.com/quasoft/pgmig/logger"
+	"github.com/quasoft/pgmig/mig"
+
+	"github.com/spf13/cobra"
+)
+
+var importSession = db.NewSession()
+var importDir = mig.NewDir()
+var importFrom string
+var importTable string
+var importDryRun bool
+
+// importUnmapped is the exit code of imports, which could not map some of the versions to migration files
+const importUnmapped = 2
+
+func init() {
+	importCmd.Flags().SortFlags = false
+	addDirFlags(importCmd, importDir)
+	importCmd.Flags().StringVar(&importFrom, "from", "", "Tool to import history from (flyway | goose | golang-migrate | sqitch)")
+	importCmd.Flags().StringVar(&importTable, "history-table", "", "History table of the tool, optionally with a schema name (default: flyway_schema_history, goose_db_version, schema_migrations or sqitch.changes)")
+	importCmd.Flags().BoolVar(&importDryRun, "dry-run", false, "Only report how the history would be imported, without changing the changelog")
+	importCmd.Flags().StringP("host", "", "localhost", "Hostname or IP address of PostgreSQL server")
+	importCmd.Flags().StringP("port", "p", "5432", "The port of the DB instance")
+	importCmd.Flags().StringP("database", "d", "localhost", "Hostname or IP address of PostgreSQL server")
+	importCmd.Flags().StringP("username", "U", "", "The username of a superuser")
+	importCmd.Flags().StringP("ssl-mode", "s", "disable", "SSL mode (disable | allow | prefer | require | verify-ca | validate-full)")
+	importCmd.Flags().StringVarP(&importSession.ChangelogName, "changelog-name", "n", "changelog", "Name of table to write change logs to")
+	addConnectFlags(importCmd, importSession)
+	importCmd.Flags().BoolP("interactive", "i", true, "Ask for password if not provided in PGPASSWORD environment variable or the PGPASSFILE")
+	importCmd.MarkFlagRequired("from")
+	rootCmd.AddCommand(importCmd)
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import --from <tool> [--history-table <name>] [--dry-run] [--dir <path>] [--recursive] [--include-dir <glob>] [--exclude-dir <glob>] [--include <glob>] [--exclude <glob>] [--strict] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--changelog-name <string>] [--wait <duration>] [--connect-timeout <duration>] [--driver <name>] [--interactive]",
+	Short: "Import the migration history of Flyway, goose, golang-migrate or sqitch into the changelog",
+	Long: `Import the migration history of Flyway, goose, golang-migrate or sqitch into the changelog,
+so that a database migrated with another tool can be migrated with pgmig from now on.
+
+The history table of the tool is read from the database and each recorded migration is mapped
+to the migration file with the same file name, the same version, or (for sqitch changes) the same
+title. The original timestamps and users are kept, if the tool records them. golang-migrate only
+records the current version, so all earlier migrations are imported as applied, and Flyway
+baselines mark earlier migrations as applied too.
+
+Migrations already in the changelog are not changed. Versions that cannot be mapped, like Flyway
+repeatable migrations, are reported and the command exits with status 2.`,
+	Example: `  Import the history of Flyway, after renaming V3__Add_index.sql to 0003_Add_index.sql:
+  pgmig import --from flyway -D ~/proj/db/migrations -d testdb
+
+  Show how the goose history in a custom table would be imported:
+  pgmig import --from goose --history-table app.goose_db_version -d testdb --dry-run
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ParseFlagsOrEnv(importSession, cmd)
+		l := targetLog(importSession)
+
+		tool, err := db.ParseTool(importFrom)
+		if err != nil {
+			l.Error("Invalid --from", errFields(err))
+			os.Exit(1)
+		}
+
+		migrations, err := importDir.Migrations()
+		logDirWarnings(l, importDir)
+		if err != nil {
+			l.Error("Could not find migrations", errFields(err))
+			os.Exit(1)
+		}
+
+		// Connect to DB
+		l.Info("Connecting")
+		err = importSession.Connect()
+		if err != nil {
+			l.Error("Could not connect", errFields(err))
+			os.Exit(1)
+		}
+		defer importSession.Disconnect()
+
+		records, err := importSession.History(tool, importTable)
+		if err != nil {
+			l.Error("Could not read history", errFields(err))
+			importSession.Disconnect()
+			os.Exit(1)
+		}
+		entries, unmapped := db.MapHistory(tool, records, migrations)
+		for _, r := range unmapped {
+			l.Warn("Could not map version to a migration file", logger.Fields{"from": tool, "version": r.String()})
+		}
+
+		existing := map[int]bool{}
+		if importDryRun {
+			existing, err = changelogVersions(importSession)
+			if err != nil {
+				l.Error("Could not read changelog", errFields(err))
+				importSession.Disconnect()
+				os.Exit(1)
+			}
+		} else {
+			err = importSession.EnsureChangelogExists()
+			if err != nil {
+				l.Error("Changelog table does not exist and could not be created", errFields(err))
+				importSession.Disconnect()
+				os.Exit(1)
+			}
+			// Existing versions are checked and the others imported in a single transaction
+			conflicts, err := importSession.ImportEntries(entries, db.SkipOnConflict)
+			if err != nil {
+				l.Error("Could not import history, nothing imported", errFields(err))
+				importSession.Disconnect()
+				os.Exit(1)
+			}
+			for _, ver := range conflicts {
+				existing[ver] = true
+			}
+		}
+
+		imported, skipped := 0, 0
+		for _, e := range entries {
+			fields := logger.Fields{"version": e.Version, "file": e.FileName, "applied_by": e.AppliedBy, "applied_at": e.DateTime, "state": e.State}
+			switch {
+			case existing[e.Version]:
+				l.Warn("Migration already in changelog, not imported", fields)
+				skipped++
+			case importDryRun:
+				l.Info("Would import migration", fields)
+			default:
+				l.Info("Imported migration", fields)
+				imported++
+			}
+		}
+
+		l.Info("Imported history", logger.Fields{"from": tool, "imported": imported, "skipped": skipped, "unmapped": len(unmapped)})
+		if len(unmapped) > 0 {
+			importSession.Disconnect()
+			os.Exit(importUnmapped)
+		}
+	},
+}
+
+// changelogVersions returns the versions recorded in the changelog of the session, if it exists
+func changelogVersions(s *db.Session) (map[int]bool, error) {
+	versions := map[int]bool{}
+	exists, err := s.ChangelogExists()
+	if err != nil || !exists {
+		return versions, err
+	}
+	entries, err := s.Changelog()
+	for _, e := range entries {
+		versions[e.Version] = true
+	}
+	return versions, err
+}
@@ -1,15 +1,19 @@
 package cmd
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/quasoft/pgmig/db"
+	"github.com/quasoft/pgmig/logger"
 
 	"github.com/spf13/cobra"
 )
 
 var initSession = db.NewSession()
+var initCreateDatabase bool
+var initMaintenanceDB string
+var initDatabaseOptions db.DatabaseOptions
+var initCreateRole string
 
 func init() {
 	initCmd.Flags().SortFlags = false
@@ -18,13 +22,21 @@ func init() {
 	initCmd.Flags().StringP("database", "d", "localhost", "Hostname or IP address of PostgreSQL server")
 	initCmd.Flags().StringP("username", "U", "", "The username of a superuser")
 	initCmd.Flags().StringP("ssl-mode", "s", "disable", "SSL mode (disable | allow | prefer | require | verify-ca | validate-full)")
+	initCmd.Flags().BoolVar(&initCreateDatabase, "create-database", false, "Create the database, if it does not exist, by connecting to the maintenance database")
+	initCmd.Flags().StringVar(&initMaintenanceDB, "maintenance-db", "postgres", "Database to connect to for creating the database")
+	initCmd.Flags().StringVar(&initDatabaseOptions.Owner, "owner", "", "Role owning the created database (default: the connecting user)")
+	initCmd.Flags().StringVar(&initDatabaseOptions.Encoding, "encoding", "", "Encoding of the created database, eg. UTF8")
+	initCmd.Flags().StringVar(&initDatabaseOptions.Locale, "locale", "", "Collation and character classification of the created database, eg. en_US.UTF-8")
+	initCmd.Flags().StringVar(&initDatabaseOptions.Template, "template", "", "Template to create the database from (default: template1, or template0 with --encoding or --locale)")
+	initCmd.Flags().StringVar(&initCreateRole, "create-role", "", "Create a login role with the privileges needed to apply migrations, if it does not exist (password is read from PGMIG_ROLE_PASSWORD)")
 	initCmd.Flags().StringVarP(&initSession.ChangelogName, "changelog-name", "n", "changelog", "Name of table to write change logs to")
+	addConnectFlags(initCmd, initSession)
 	initCmd.Flags().BoolP("interactive", "i", true, "Ask for password if not provided in PGPASSWORD environment variable or the PGPASSFILE")
 	rootCmd.AddCommand(initCmd)
 }
 
 var initCmd = &cobra.Command{
-	Use:   "init [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--changelog-name <string>] [--interactive]",
+	Use:   "init [--create-database] [--maintenance-db <string>] [--owner <string>] [--encoding <string>] [--locale <string>] [--template <string>] [--create-role <string>] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--changelog-name <string>] [--wait <duration>] [--connect-timeout <duration>] [--driver <name>] [--interactive]",
 	Short: "Create changelog table in specified PostgreSQL database",
 	Example: `  Specify database with PG environment variables:
   pgmig init
@@ -34,15 +46,27 @@ var initCmd = &cobra.Command{
 
   Provide password interactively:
   pgmig init --host 10.0.0.1 -d testdb -U postgres -i
+
+  Create the database and a role for applying migrations, if they do not exist:
+  PGMIG_ROLE_PASSWORD=secret pgmig init --host 10.0.0.1 -d testdb -U postgres --create-database --encoding UTF8 --create-role migrator
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		ParseFlagsOrEnv(initSession, cmd)
 
+		if initCreateDatabase || initCreateRole != "" {
+			err := prepareDatabase(initSession)
+			if err != nil {
+				os.Exit(1)
+			}
+		}
+
+		l := targetLog(initSession)
+
 		// Connect to DB
-		fmt.Printf("Connecting to %s:%s\n", initSession.Host, initSession.Port)
+		l.Info("Connecting")
 		err := initSession.Connect()
 		if err != nil {
-			fmt.Println("Error: " + err.Error())
+			l.Error("Could not connect", errFields(err))
 			os.Exit(1)
 		}
 		defer initSession.Disconnect()
@@ -50,11 +74,70 @@ var initCmd = &cobra.Command{
 		// Create changelog table if it does not exist
 		err = initSession.EnsureChangelogExists()
 		if err != nil {
-			fmt.Printf("Error: changelog table does not exists and could not be created: %s\n", err)
+			l.Error("Changelog table does not exist and could not be created", errFields(err))
 			initSession.Disconnect()
 			os.Exit(1)
 		}
+		l.Info("Changelog table created", logger.Fields{"changelog": initSession.ChangelogName})
 
-		fmt.Println("Changelog table created.")
+		if initCreateRole != "" {
+			err = initSession.GrantMigrationRole(initCreateRole)
+			if err != nil {
+				l.Error("Could not grant privileges to migration role", errFields(err))
+				initSession.Disconnect()
+				os.Exit(1)
+			}
+			l.Info("Privileges granted to migration role", logger.Fields{"role": initCreateRole})
+		}
 	},
 }
+
+// prepareDatabase connects to the maintenance database and creates the database of the session
+// (with --create-database) and the migration role (with --create-role), unless they exist.
+// Errors are logged.
+func prepareDatabase(s *db.Session) error {
+	maint := s.Clone()
+	maint.Database = initMaintenanceDB
+	l := targetLog(maint)
+
+	l.Info("Connecting")
+	err := maint.Connect()
+	if err != nil {
+		l.Error("Could not connect", errFields(err))
+		return err
+	}
+	defer maint.Disconnect()
+
+	if initCreateDatabase {
+		exists, err := maint.DatabaseExists(s.Database)
+		if err == nil && !exists {
+			err = maint.CreateDatabase(s.Database, initDatabaseOptions)
+			if err == nil {
+				l.Info("Database created", logger.Fields{"database": s.Database})
+			}
+		} else if err == nil {
+			l.Info("Database already exists", logger.Fields{"database": s.Database})
+		}
+		if err != nil {
+			l.Error("Could not create database", errFields(err))
+			return err
+		}
+	}
+
+	if initCreateRole != "" {
+		exists, err := maint.RoleExists(initCreateRole)
+		if err == nil && !exists {
+			err = maint.CreateRole(initCreateRole, os.Getenv("PGMIG_ROLE_PASSWORD"))
+			if err == nil {
+				l.Info("Role created", logger.Fields{"role": initCreateRole})
+			}
+		} else if err == nil {
+			l.Info("Role already exists", logger.Fields{"role": initCreateRole})
+		}
+		if err != nil {
+			l.Error("Could not create role", errFields(err))
+			return err
+		}
+	}
+	return nil
+}
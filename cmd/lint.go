@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/quasoft/pgmig/db"
+	"github.com/quasoft/pgmig/lint"
+	"github.com/quasoft/pgmig/logger"
+	"github.com/quasoft/pgmig/mig"
+
+	"github.com/spf13/cobra"
+)
+
+var lintSession = db.NewSession()
+var lintDir = mig.NewDir()
+var lintAll bool
+var lintDisable []string
+var lintEnable []string
+var lintFormat string
+
+func init() {
+	lintCmd.Flags().SortFlags = false
+	addDirFlags(lintCmd, lintDir)
+	lintCmd.Flags().BoolVarP(&lintAll, "all", "a", false, "Lint all migration files, without connecting to the database to find pending ones")
+	lintCmd.Flags().StringSliceVar(&lintDisable, "disable", nil, "Lint rules to disable (can be repeated)")
+	lintCmd.Flags().StringSliceVar(&lintEnable, "enable", nil, "Lint rules to enable, disabling all others (can be repeated)")
+	lintCmd.Flags().StringVarP(&lintFormat, "format", "f", "text", "Output format (text | json)")
+	lintCmd.Flags().StringP("host", "", "localhost", "Hostname or IP address of PostgreSQL server")
+	lintCmd.Flags().StringP("port", "p", "5432", "The port of the DB instance")
+	lintCmd.Flags().StringP("database", "d", "localhost", "Hostname or IP address of PostgreSQL server")
+	lintCmd.Flags().StringP("username", "U", "", "The username of a superuser")
+	lintCmd.Flags().StringP("ssl-mode", "s", "disable", "SSL mode (disable | allow | prefer | require | verify-ca | validate-full)")
+	lintCmd.Flags().StringVarP(&lintSession.ChangelogName, "changelog-name", "n", "changelog", "Name of table to write change logs to")
+	addConnectFlags(lintCmd, lintSession)
+	lintCmd.Flags().BoolP("interactive", "i", true, "Ask for password if not provided in PGPASSWORD environment variable or the PGPASSFILE")
+	rootCmd.AddCommand(lintCmd)
+}
+
+var lintCmd = &cobra.Command{
+	Use:   "lint [--dir <path>] [--all] [--disable <rule>] [--enable <rule>] [--format <text|json>] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--changelog-name <string>] [--wait <duration>] [--connect-timeout <duration>] [--driver <name>] [--interactive]",
+	Short: "Checks pending migration files for operations that take heavy locks or cause outages",
+	Long: `Checks pending migration files for operations that take heavy locks or cause outages.
+
+A rule can be suppressed for a single statement with a "-- pgmig:lint-disable <rule>" comment
+on the line before the statement or at the end of it, and for a whole file with a
+"-- pgmig:lint-disable-file <rule>" comment. Omitting the rule name suppresses all rules.
+
+Exits with status 1 if any problems are found.`,
+	Example: `  Lint migrations that have not been applied to the database yet:
+  pgmig lint -D ~/proj/db/migrations --host 10.0.0.1 -d testdb -U postgres
+
+  Lint all migration files without connecting to a database and print results as JSON:
+  pgmig lint -D ~/proj/db/migrations --all -f json
+
+  Lint all migration files, ignoring dropped columns:
+  pgmig lint --all --disable drop-column
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if lintFormat != "text" && lintFormat != "json" {
+			log.Error("Unknown output format", logger.Fields{"format": lintFormat})
+			os.Exit(1)
+		}
+
+		linter := lint.New()
+		err := linter.Disable(lintDisable...)
+		if err == nil && len(lintEnable) > 0 {
+			err = linter.EnableOnly(lintEnable...)
+		}
+		if err != nil {
+			log.Error("Invalid lint rules", errFields(err))
+			os.Exit(1)
+		}
+
+		l := log
+		var migrations []mig.File
+		if lintAll {
+			migrations, err = lintDir.Migrations()
+		} else {
+			ParseFlagsOrEnv(lintSession, cmd)
+			l = targetLog(lintSession)
+
+			// Connect to DB
+			l.Info("Connecting")
+			err = lintSession.Connect()
+			if err != nil {
+				l.Error("Could not connect", errFields(err))
+				os.Exit(1)
+			}
+			defer lintSession.Disconnect()
+
+			migrations, err = lintSession.PendingMigrations(lintDir)
+		}
+		if err != nil {
+			l.Error("Could not find migrations", errFields(err))
+			lintSession.Disconnect()
+			os.Exit(1)
+		}
+		logDirWarnings(l, lintDir)
+
+		findings, err := linter.Lint(migrations)
+		if err != nil {
+			l.Error("Could not lint migrations", errFields(err))
+			lintSession.Disconnect()
+			os.Exit(1)
+		}
+
+		if lintFormat == "json" {
+			if findings == nil {
+				findings = []lint.Finding{}
+			}
+			out, _ := json.MarshalIndent(findings, "", "  ")
+			fmt.Println(string(out))
+		} else {
+			for _, f := range findings {
+				fmt.Println(f)
+			}
+		}
+		l.Info("Linted migrations", logger.Fields{"migrations": len(migrations), "problems": len(findings)})
+
+		if len(findings) > 0 {
+			lintSession.Disconnect()
+			os.Exit(1)
+		}
+	},
+}
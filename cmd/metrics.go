@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/quasoft/pgmig/db"
+	"github.com/quasoft/pgmig/logger"
+	"github.com/quasoft/pgmig/metrics"
+	"github.com/quasoft/pgmig/mig"
+
+	"github.com/spf13/cobra"
+)
+
+// runMetrics collects the metrics of the current run, if enabled with --metrics-file or --metrics-addr
+var runMetrics *metrics.Registry
+var metricsFile string
+var metricsAddr string
+
+// addMetricsFlags adds flags for exposing metrics to the command
+func addMetricsFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&metricsFile, "metrics-file", "", "File to write Prometheus metrics to, eg. for the textfile collector of node_exporter")
+	cmd.Flags().StringVar(&metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on, eg. localhost:9187 (keeps serving after the run, until interrupted)")
+}
+
+// startMetrics enables collection of metrics, if requested, and starts serving them on --metrics-addr
+func startMetrics() {
+	if metricsFile == "" && metricsAddr == "" {
+		return
+	}
+	runMetrics = metrics.New()
+	runMetrics.Register("pgmig_applied_version", "Version of the last applied migration", metrics.Gauge)
+	runMetrics.Register("pgmig_pending_migrations", "Number of migrations that have not been applied yet", metrics.Gauge)
+	runMetrics.Register("pgmig_failed_migrations", "Number of migrations in failed or interrupted state", metrics.Gauge)
+	runMetrics.Register("pgmig_last_apply_timestamp_seconds", "Time when the last migration was applied, as a Unix timestamp", metrics.Gauge)
+	runMetrics.Register("pgmig_migration_duration_seconds", "Time it took to apply the migration", metrics.Gauge)
+	runMetrics.Register("pgmig_apply_errors_total", "Number of failed attempts to apply migrations", metrics.Counter)
+
+	if metricsAddr != "" {
+		go func() {
+			err := http.ListenAndServe(metricsAddr, runMetrics)
+			if err != nil {
+				log.Error("Could not serve metrics", logger.Fields{"addr": metricsAddr}, errFields(err))
+			}
+		}()
+	}
+}
+
+// finishMetrics writes the collected metrics to --metrics-file. When serving metrics on --metrics-addr,
+// it blocks until the process is interrupted, so that they can be scraped, unless the run itself was interrupted.
+func finishMetrics(ctx context.Context) {
+	if runMetrics == nil {
+		return
+	}
+	if metricsFile != "" {
+		err := runMetrics.WriteFile(metricsFile)
+		if err != nil {
+			log.Error("Could not write metrics", errFields(err))
+		} else {
+			log.Info("Metrics written", logger.Fields{"file": metricsFile})
+		}
+	}
+	if metricsAddr != "" && ctx.Err() == nil {
+		log.Info("Serving metrics until interrupted", logger.Fields{"addr": metricsAddr})
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+	}
+}
+
+// metricLabels returns the labels identifying the database and changelog of the session
+func metricLabels(s *db.Session) metrics.Labels {
+	return metrics.Labels{"database": targetName(s), "changelog": s.ChangelogName}
+}
+
+// recordStatus records the applied version, pending and failed counts and the time of the last applied
+// migration of the database
+func recordStatus(s *db.Session, statuses []db.Status) {
+	if runMetrics == nil {
+		return
+	}
+	var version, pending, failed int
+	var last time.Time
+	for _, st := range statuses {
+		switch st.State {
+		case db.StateApplied, db.StateAhead:
+			if st.Ver > version {
+				version = st.Ver
+			}
+			if st.AppliedAt.After(last) {
+				last = st.AppliedAt
+			}
+		case db.StateSkipped:
+			if st.Ver > version {
+				version = st.Ver
+			}
+		case db.StatePending:
+			pending++
+		case db.StateFailed, db.StateInterrupted:
+			failed++
+		}
+	}
+
+	labels := metricLabels(s)
+	runMetrics.Set("pgmig_applied_version", labels, float64(version))
+	runMetrics.Set("pgmig_pending_migrations", labels, float64(pending))
+	runMetrics.Set("pgmig_failed_migrations", labels, float64(failed))
+	if !last.IsZero() {
+		runMetrics.Set("pgmig_last_apply_timestamp_seconds", labels, float64(last.Unix()))
+	}
+}
+
+// recordDuration records the time it took to apply the migration
+func recordDuration(s *db.Session, m *mig.File, d time.Duration) {
+	if runMetrics == nil {
+		return
+	}
+	labels := metricLabels(s)
+	labels["version"] = strconv.Itoa(m.Ver)
+	runMetrics.Set("pgmig_migration_duration_seconds", labels, d.Seconds())
+}
+
+// recordApplyError counts a failed attempt to apply migrations to the database
+func recordApplyError(s *db.Session) {
+	if runMetrics == nil {
+		return
+	}
+	runMetrics.Add("pgmig_apply_errors_total", metricLabels(s), 1)
+}
+
+// recordDatabaseStatus reads the status of the migrations in the database and records it
+func recordDatabaseStatus(s *db.Session, dir *mig.Dir, l *logger.Logger) {
+	if runMetrics == nil {
+		return
+	}
+	// Scan a copy, so that warnings are not reported twice
+	d := *dir
+	statuses, err := s.Status(&d)
+	if err != nil {
+		l.Warn("Could not record metrics", errFields(err))
+		return
+	}
+	recordStatus(s, statuses)
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/quasoft/pgmig/logger"
+	"github.com/quasoft/pgmig/mig"
+	"github.com/quasoft/pgmig/notify"
+
+	"github.com/spf13/cobra"
+)
+
+var notifyURLs []string
+var notifyCommands []string
+var notifyRetries int
+
+// notifiers receive the results of apply runs
+var notifiers []notify.Notifier
+
+// addNotifyFlags adds flags for notifications about apply results to the command
+func addNotifyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&notifyURLs, "notify-url", nil, "URL to post a JSON notification to on apply start, success and failure (can be repeated)")
+	cmd.Flags().StringSliceVar(&notifyCommands, "notify-command", nil, "Shell command to run with a JSON notification on stdin on apply start, success and failure (can be repeated)")
+	cmd.Flags().IntVar(&notifyRetries, "notify-retries", 3, "Number of times to retry a failed webhook notification")
+}
+
+// setupNotifiers creates the notifiers from the flags and the config file
+func setupNotifiers(c *config) {
+	urls := append(append([]string{}, c.Notify.URLs...), notifyURLs...)
+	commands := append(append([]string{}, c.Notify.Commands...), notifyCommands...)
+	for _, url := range urls {
+		w := notify.NewWebhook(url)
+		w.Retries = notifyRetries
+		notifiers = append(notifiers, w)
+	}
+	for _, command := range commands {
+		notifiers = append(notifiers, &notify.Command{Command: command})
+	}
+}
+
+// sendNotification notifies all notifiers about the event. Pending migrations are included in start events.
+// Failed notifications are logged, but do not fail the run.
+func sendNotification(l *logger.Logger, event notify.Event, res applyResult, pending []mig.File) {
+	if len(notifiers) == 0 {
+		return
+	}
+	p := notify.Payload{
+		Event:    event,
+		Target:   res.Target,
+		Time:     time.Now().UTC(),
+		Applied:  res.Migrations,
+		FailedAt: res.FailedAt,
+	}
+	if p.Applied == nil {
+		p.Applied = []notify.Migration{}
+	}
+	for _, m := range pending {
+		p.Pending = append(p.Pending, m.Ver)
+	}
+	if res.Err != nil {
+		p.Error = res.Err.Error()
+	}
+
+	for _, n := range notifiers {
+		err := n.Notify(p)
+		if err != nil {
+			l.Warn("Could not send notification", logger.Fields{"event": event}, errFields(err))
+		}
+	}
+}
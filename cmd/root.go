@@ -3,8 +3,10 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/quasoft/pgmig/db"
+	"github.com/quasoft/pgmig/logger"
 	"github.com/quasoft/pgmig/mig"
 
 	"github.com/spf13/cobra"
@@ -12,66 +14,162 @@ import (
 
 var rootSession = db.NewSession()
 var rootDir = mig.NewDir()
+var rootTenantSchemas string
+var rootChangelogFile string
 
 func init() {
+	rootCmd.PersistentPreRun = configureLog
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Minimum level of logged events (debug | info | warn | error)")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Format of logged events (text | json)")
 	rootCmd.Flags().SortFlags = false
-	rootCmd.Flags().StringVarP(&rootDir.Path, "dir", "D", "", "Local directory with migration scripts (default: current dir)")
+	addDirFlags(rootCmd, rootDir)
 	rootCmd.Flags().StringP("host", "", "localhost", "Hostname or IP address of PostgreSQL server")
 	rootCmd.Flags().StringP("port", "p", "5432", "The port of the DB instance")
 	rootCmd.Flags().StringP("database", "d", "localhost", "Hostname or IP address of PostgreSQL server")
 	rootCmd.Flags().StringP("username", "U", "", "The username of a superuser")
 	rootCmd.Flags().StringP("ssl-mode", "s", "disable", "SSL mode (disable | allow | prefer | require | verify-ca | validate-full)")
 	rootCmd.Flags().StringVarP(&rootSession.ChangelogName, "changelog-name", "n", "changelog", "Name of table to write change logs to")
+	rootCmd.Flags().StringVar(&rootChangelogFile, "changelog-file", "", "JSON file with a copy of the changelog to compare the directory with, instead of connecting to the database")
+	rootCmd.Flags().StringVar(&rootTenantSchemas, "tenant-schemas", "", "LIKE pattern for schemas to check, reporting the ones that are behind (eg. tenant_%)")
+	addConnectFlags(rootCmd, rootSession)
 	rootCmd.Flags().BoolP("interactive", "i", true, "Ask for password if not provided in PGPASSWORD environment variable or the PGPASSFILE")
 }
 
 var rootCmd = &cobra.Command{
-	Use:   "pgmig [--dir <path>] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--changelog-name <string>] [--interactive]",
+	Use:   "pgmig [--dir <path>] [--recursive] [--include-dir <glob>] [--exclude-dir <glob>] [--include <glob>] [--exclude <glob>] [--strict] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--changelog-name <string>] [--changelog-file <path>] [--tenant-schemas <pattern>] [--wait <duration>] [--connect-timeout <duration>] [--driver <name>] [--interactive]",
 	Short: "Check if directory contains migration files, which have not been applied yet",
 	Example: `  Checks current directory for migration files that have not been applied to the database specified by PG environment variables:
   pgmig
 
   Checks the directory and database specified with command arguments:
   pgmig -D ~/proj/db/migrations --host 10.0.0.1 -d testdb -U postgres
+
+  Plan offline, listing the migrations that are pending according to a copy of the changelog:
+  pgmig -D ~/proj/db/migrations --changelog-file changelog.json
+
+  Report tenant schemas that are behind:
+  pgmig -d saas --tenant-schemas 'tenant_%'
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		ParseFlagsOrEnv(rootSession, cmd)
 
-		// Connect to DB
-		fmt.Printf("Connecting to %s:%s\n", rootSession.Host, rootSession.Port)
-		err := rootSession.Connect()
-		if err != nil {
-			fmt.Println("Error: " + err.Error())
-			os.Exit(1)
+		if rootTenantSchemas != "" {
+			os.Exit(checkTenants(rootSession, rootDir, rootTenantSchemas))
+		}
+
+		l := targetLog(rootSession)
+
+		if rootChangelogFile != "" {
+			// Plan against a copy of the changelog, without connecting
+			_, err := os.Stat(rootChangelogFile)
+			var store *db.FileStore
+			if err == nil {
+				store, err = db.NewFileStore(rootChangelogFile)
+			}
+			if err != nil {
+				l.Error("Could not read changelog file", errFields(err))
+				os.Exit(1)
+			}
+			rootSession.Store = store
+			l = log.With(logger.Fields{"changelog_file": rootChangelogFile})
+		} else {
+			// Connect to DB
+			l.Info("Connecting")
+			err := rootSession.Connect()
+			if err != nil {
+				l.Error("Could not connect", errFields(err))
+				os.Exit(1)
+			}
+			defer rootSession.Disconnect()
 		}
-		defer rootSession.Disconnect()
 
 		// Scan specified directory for migration files that have not been applied (with ID > lastID)
 		migrations, err := rootSession.PendingMigrations(rootDir)
+		logDirWarnings(l, rootDir)
 		if err != nil {
-			fmt.Println("Error: " + err.Error())
+			l.Error("Could not find pending migrations", errFields(err))
 			rootSession.Disconnect()
 			os.Exit(1)
 		}
 
 		if len(migrations) == 0 {
 			fmt.Println("There are no pending migrations to apply.")
+			l.Debug("There are no pending migrations to apply")
 			rootSession.Disconnect()
 			os.Exit(0)
 		}
 
-		// Print information about each pending migration
+		// Print the pending migrations to stdout, so that the list is not hidden by --log-level
 		fmt.Println("List of pending migrations:")
 		fmt.Println("---------------------------")
 		for _, m := range migrations {
-			fmt.Printf("#%d, %s (file %s)\r\n", m.Ver, m.Title, m.FileName)
+			fields := logger.Fields{"version": m.Ver, "title": m.Title, "file": m.RelPath}
+			if len(m.Contexts) > 0 {
+				fields["contexts"] = strings.Join(m.Contexts, ",")
+				fmt.Printf("#%d, %s (file %s, contexts %s)\r\n", m.Ver, m.Title, m.RelPath, fields["contexts"])
+			} else {
+				fmt.Printf("#%d, %s (file %s)\r\n", m.Ver, m.Title, m.RelPath)
+			}
+			l.Debug("Pending migration", fields)
 		}
+		l.Debug("Found pending migrations", logger.Fields{"pending": len(migrations)})
 	},
 }
 
+// checkTenants reports the tenant schemas matching the pattern, which are behind.
+// Returns 1 if the check failed, otherwise 0.
+func checkTenants(base *db.Session, dir *mig.Dir, pattern string) int {
+	l := targetLog(base)
+	l.Info("Looking for tenant schemas", logger.Fields{"pattern": pattern})
+	tenants, err := tenantSessions(base, pattern)
+	if err != nil {
+		l.Error("Could not find tenant schemas", errFields(err))
+		return 1
+	}
+
+	all, err := dir.Migrations()
+	logDirWarnings(l, dir)
+	if err != nil {
+		l.Error("Could not find migrations", errFields(err))
+		return 1
+	}
+
+	behind := 0
+	for _, s := range tenants {
+		pending, err := tenantPending(s, dir, len(all))
+		if err != nil {
+			l.Error("Could not check tenant schema", logger.Fields{"schema": s.Schema}, errFields(err))
+			return 1
+		}
+		if pending > 0 {
+			l.Warn("Tenant schema is behind", logger.Fields{"schema": s.Schema, "pending": pending})
+			behind++
+		}
+	}
+	l.Info("Checked tenant schemas", logger.Fields{"tenants": len(tenants), "behind": behind})
+	return 0
+}
+
+// tenantPending returns the number of pending migrations for the tenant schema of the session.
+// Schemas without a changelog table have all migrations pending.
+func tenantPending(s *db.Session, dir *mig.Dir, total int) (int, error) {
+	err := s.Connect()
+	if err != nil {
+		return 0, err
+	}
+	defer s.Disconnect()
+
+	exists, err := s.ChangelogExists()
+	if err != nil || !exists {
+		return total, err
+	}
+	pending, err := s.PendingMigrations(dir)
+	return len(pending), err
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		log.Error("Command failed", errFields(err))
 		os.Exit(1)
 	}
 }
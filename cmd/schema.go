@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/quasoft/pgmig/db"
+
+	"github.com/spf13/cobra"
+)
+
+var schemaSession = db.NewSession()
+var schemaOutput string
+
+func init() {
+	schemaDumpCmd.Flags().SortFlags = false
+	schemaDumpCmd.Flags().StringVarP(&schemaOutput, "output", "o", "", "File to write the schema to (default: standard output)")
+	schemaDumpCmd.Flags().StringP("host", "", "localhost", "Hostname or IP address of PostgreSQL server")
+	schemaDumpCmd.Flags().StringP("port", "p", "5432", "The port of the DB instance")
+	schemaDumpCmd.Flags().StringP("database", "d", "localhost", "Hostname or IP address of PostgreSQL server")
+	schemaDumpCmd.Flags().StringP("username", "U", "", "The username of a superuser")
+	schemaDumpCmd.Flags().StringP("ssl-mode", "s", "disable", "SSL mode (disable | allow | prefer | require | verify-ca | validate-full)")
+	schemaDumpCmd.Flags().StringVarP(&schemaSession.ChangelogName, "changelog-name", "n", "changelog", "Name of changelog table to exclude from the schema")
+	addConnectFlags(schemaDumpCmd, schemaSession)
+	schemaDumpCmd.Flags().BoolP("interactive", "i", true, "Ask for password if not provided in PGPASSWORD environment variable or the PGPASSFILE")
+	schemaCmd.AddCommand(schemaDumpCmd)
+	rootCmd.AddCommand(schemaCmd)
+}
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Commands for working with the schema of a PostgreSQL database",
+}
+
+var schemaDumpCmd = &cobra.Command{
+	Use:   "dump [--output <path>] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--changelog-name <string>] [--wait <duration>] [--connect-timeout <duration>] [--driver <name>] [--interactive]",
+	Short: "Writes a sorted, diff-friendly description of the database schema as DDL, built from the system catalogs",
+	Example: `  Write the schema of the database to schema.sql:
+  pgmig schema dump --host 10.0.0.1 -d testdb -U postgres -o ~/proj/db/schema.sql
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ParseFlagsOrEnv(schemaSession, cmd)
+
+		l := targetLog(schemaSession)
+
+		// Connect to DB
+		l.Info("Connecting")
+		err := schemaSession.Connect()
+		if err != nil {
+			l.Error("Could not connect", errFields(err))
+			os.Exit(1)
+		}
+		defer schemaSession.Disconnect()
+
+		err = dumpSchema(schemaSession, schemaOutput)
+		if err != nil {
+			l.Error("Could not dump schema", errFields(err))
+			schemaSession.Disconnect()
+			os.Exit(1)
+		}
+	},
+}
+
+// dumpSchema writes the schema of the database to the file at the given path, or to the
+// standard output if the path is empty
+func dumpSchema(s *db.Session, path string) error {
+	var buf bytes.Buffer
+	err := s.DumpSchema(&buf)
+	if err != nil {
+		return err
+	}
+
+	if path == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("could not write schema to %s: %v", path, err)
+	}
+	return nil
+}
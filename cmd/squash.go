@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/quasoft/pgmig/logger"
+	"github.com/quasoft/pgmig/mig"
+
+	"github.com/spf13/cobra"
+)
+
+var squashDir = mig.NewDir()
+var squashThrough int
+var squashArchiveDir string
+
+func init() {
+	squashCmd.Flags().SortFlags = false
+	addDirFlags(squashCmd, squashDir)
+	squashCmd.Flags().IntVarP(&squashThrough, "through", "t", 0, "Version of the last migration to squash")
+	squashCmd.Flags().StringVar(&squashArchiveDir, "archive-dir", mig.DefaultArchiveDir, "Directory, relative to the migrations directory, to move squashed files to")
+	squashCmd.MarkFlagRequired("through")
+	rootCmd.AddCommand(squashCmd)
+}
+
+var squashCmd = &cobra.Command{
+	Use:   "squash --through <int> [--dir <path>] [--archive-dir <path>]",
+	Short: "Replaces old migrations with a single baseline migration",
+	Long: `Replaces old migrations with a single baseline migration.
+
+All migrations with versions up to and including the one given with --through are concatenated into
+a baseline file, which gets the version of the last squashed migration. The baseline records the range
+of versions it replaces in a "-- pgmig:replaces <from>-<to>" comment. Databases that already have those
+migrations applied treat the baseline as applied, while fresh databases run only the baseline.
+
+The baseline runs in a single transaction, as the session user. Migrations marked with no-transaction,
+or setting their own role, run-time parameters or timeouts, cannot be squashed; choose an earlier --through.
+
+The squashed files are moved to the archive directory, which is hidden by default, so it is not
+scanned for migrations.`,
+	Example: `  Squash migrations 1 to 600 into a baseline:
+  pgmig squash -D ~/proj/db/migrations --through 600
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		baseline, err := squashDir.Squash(squashThrough, squashArchiveDir)
+		logDirWarnings(log, squashDir)
+		if err != nil {
+			log.Error("Could not squash migrations", errFields(err))
+			os.Exit(1)
+		}
+		log.Info("Migrations squashed", logger.Fields{"from": baseline.Header.ReplacesFrom, "to": baseline.Header.ReplacesTo, "file": baseline.FileName})
+	},
+}
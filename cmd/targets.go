@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/quasoft/pgmig/db"
+)
+
+// readTargets reads target definitions from a file, one per line. Empty lines and lines
+// starting with # are skipped.
+func readTargets(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read targets file %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var targets []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		targets = append(targets, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read targets file %s: %v", path, err)
+	}
+	return targets, nil
+}
+
+// targetSession creates a session for the target, based on the settings of the given session.
+// A target is either a database name (eg. "customer_001") or a list of connection parameters
+// (eg. "host=10.0.0.2 port=5433 dbname=customer_002 user=postgres sslmode=require").
+func targetSession(base *db.Session, target string) (*db.Session, error) {
+	s := base.Clone()
+	if !strings.Contains(target, "=") {
+		s.Database = target
+		return s, nil
+	}
+
+	for _, param := range strings.Fields(target) {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid parameter %q in target %q", param, target)
+		}
+		switch kv[0] {
+		case "host":
+			s.Host = kv[1]
+		case "port":
+			s.Port = kv[1]
+		case "dbname":
+			s.Database = kv[1]
+		case "user":
+			s.Username = kv[1]
+		case "sslmode":
+			s.SslMode = kv[1]
+		default:
+			return nil, fmt.Errorf("unknown parameter %q in target %q", kv[0], target)
+		}
+	}
+	return s, nil
+}
+
+// targetSessions creates a session for each of the targets
+func targetSessions(base *db.Session, targets []string) ([]*db.Session, error) {
+	var sessions []*db.Session
+	for _, t := range targets {
+		s, err := targetSession(base, t)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// tenantSessions creates a session for each schema in the database of the given session,
+// whose name matches the LIKE pattern (eg. "tenant_%")
+func tenantSessions(base *db.Session, pattern string) ([]*db.Session, error) {
+	err := base.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer base.Disconnect()
+
+	schemas, err := base.Schemas(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*db.Session
+	for _, schema := range schemas {
+		s := base.Clone()
+		s.Schema = schema
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// targetName returns a short name for the target, used to prefix messages
+func targetName(s *db.Session) string {
+	name := fmt.Sprintf("%s:%s/%s", s.Host, s.Port, s.Database)
+	if s.Schema != "" {
+		name += "/" + s.Schema
+	}
+	return name
+}
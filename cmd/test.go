@@ -0,0 +1,230 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/quasoft/pgmig/db"
+	"github.com/quasoft/pgmig/logger"
+	"github.com/quasoft/pgmig/mig"
+
+	"github.com/spf13/cobra"
+)
+
+var testSession = db.NewSession()
+var testDir = mig.NewDir()
+var testTemplate string
+var testKeep bool
+
+func init() {
+	testCmd.Flags().SortFlags = false
+	addDirFlags(testCmd, testDir)
+	testCmd.Flags().StringVar(&testTemplate, "template", "", "Template to create the scratch database from (default: template1)")
+	testCmd.Flags().BoolVar(&testKeep, "keep", false, "Keep the scratch database after the test")
+	testCmd.Flags().StringP("host", "", "localhost", "Hostname or IP address of PostgreSQL server")
+	testCmd.Flags().StringP("port", "p", "5432", "The port of the DB instance")
+	testCmd.Flags().StringP("database", "d", "postgres", "Database to connect to for creating the scratch database")
+	testCmd.Flags().StringP("username", "U", "", "The username of a superuser")
+	testCmd.Flags().StringP("ssl-mode", "s", "disable", "SSL mode (disable | allow | prefer | require | verify-ca | validate-full)")
+	testCmd.Flags().StringVarP(&testSession.ChangelogName, "changelog-name", "n", "changelog", "Name of table to write change logs to")
+	addConnectFlags(testCmd, testSession)
+	testCmd.Flags().BoolP("interactive", "i", true, "Ask for password if not provided in PGPASSWORD environment variable or the PGPASSFILE")
+	rootCmd.AddCommand(testCmd)
+}
+
+var testCmd = &cobra.Command{
+	Use:   "test [--dir <path>] [--template <string>] [--keep] [--host <string>] [--port <int>] [--database <string>] [--username <string>] [--ssl-mode <string>] [--changelog-name <string>] [--wait <duration>] [--connect-timeout <duration>] [--driver <name>] [--interactive]",
+	Short: "Checks that down scripts revert their migrations, by applying them up, down and up on a scratch database",
+	Long: `Checks that down scripts revert their migrations, by applying them up, down and up on a scratch database.
+
+A temporary database is created on the server given by the connection flags. All migrations are applied,
+then reverted one by one in reverse order with their down scripts (files named like the migration, ending
+in ".down.sql"), as they would be rolled back in production. The schema is compared after each step, to make
+sure that each down script returns it to exactly the state before its migration. Finally the reverted
+migrations are applied again and the schema is compared with the one after the first run. Reverting stops
+at the first migration without a down script. The scratch database is dropped at the end.
+
+Down scripts without a matching migration are an error. Exits with status 1 if any down script is missing
+or incomplete.`,
+	Example: `  Test down scripts on a scratch database on a local server:
+  pgmig test -D ~/proj/db/migrations -U postgres
+
+  Test down scripts on a copy of a template database, keeping the scratch database for inspection:
+  pgmig test -D ~/proj/db/migrations --host 10.0.0.1 -U postgres --template app_template --keep
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ParseFlagsOrEnv(testSession, cmd)
+		l := targetLog(testSession)
+		testDir.Strict = true
+
+		migrations, err := testDir.Migrations()
+		logDirWarnings(l, testDir)
+		if err != nil {
+			l.Error("Could not find migrations", errFields(err))
+			os.Exit(1)
+		}
+
+		// Connect to DB
+		l.Info("Connecting")
+		err = testSession.Connect()
+		if err != nil {
+			l.Error("Could not connect", errFields(err))
+			os.Exit(1)
+		}
+		defer testSession.Disconnect()
+
+		// Create scratch database
+		scratch := testSession.Clone()
+		scratch.Database = fmt.Sprintf("pgmig_test_%d", time.Now().UnixNano())
+		l = l.With(logger.Fields{"scratch": scratch.Database})
+		l.Info("Creating scratch database")
+		err = testSession.CreateDatabase(scratch.Database, db.DatabaseOptions{Template: testTemplate})
+		if err != nil {
+			l.Error("Could not create scratch database", errFields(err))
+			testSession.Disconnect()
+			os.Exit(1)
+		}
+
+		problems, err := roundTrip(scratch, migrations, l)
+		scratch.Disconnect()
+
+		if testKeep {
+			l.Info("Keeping scratch database")
+		} else {
+			l.Info("Dropping scratch database")
+			dropErr := testSession.DropDatabase(scratch.Database)
+			if dropErr != nil {
+				l.Error("Could not drop scratch database", errFields(dropErr))
+			}
+		}
+
+		if err != nil {
+			l.Error("Round trip failed", errFields(err))
+			testSession.Disconnect()
+			os.Exit(1)
+		}
+		if problems > 0 {
+			l.Error("Found problems with migrations", logger.Fields{"problems": problems, "migrations": len(migrations)})
+			testSession.Disconnect()
+			os.Exit(1)
+		}
+		l.Info("All migrations passed the round trip", logger.Fields{"migrations": len(migrations)})
+	},
+}
+
+// roundTrip applies all migrations on the scratch database, then reverts them one by one in reverse order
+// and applies the reverted ones again, comparing schema snapshots after each step. Reverting stops at the
+// first migration without a down script. Returns the number of migrations with missing or incomplete down scripts.
+func roundTrip(scratch *db.Session, migrations []mig.File, l *logger.Logger) (int, error) {
+	err := scratch.Connect()
+	if err != nil {
+		return 0, err
+	}
+	err = scratch.EnsureChangelogExists()
+	if err != nil {
+		return 0, fmt.Errorf("could not create changelog table: %v", err)
+	}
+
+	// Apply all migrations, keeping the schema before each one
+	before := make([]string, len(migrations))
+	for i, m := range migrations {
+		before[i], err = snapshot(scratch)
+		if err != nil {
+			return 0, err
+		}
+		l.Info("Applying migration", logger.Fields{"version": m.Ver, "file": m.RelPath})
+		err = scratch.Apply(m)
+		if err != nil {
+			return 0, err
+		}
+	}
+	applied, err := snapshot(scratch)
+	if err != nil {
+		return 0, err
+	}
+
+	// Revert migrations in reverse order
+	problems := 0
+	reverted := len(migrations)
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		fields := logger.Fields{"version": m.Ver, "file": m.RelPath}
+		if m.DownPath == "" {
+			l.Error("No down script for migration, not reverting older migrations", fields)
+			problems++
+			break
+		}
+
+		l.Info("Reverting migration", fields)
+		err = scratch.Revert(m)
+		if err != nil {
+			return problems, err
+		}
+		reverted = i
+		after, err := snapshot(scratch)
+		if err != nil {
+			return problems, err
+		}
+		if after != before[i] {
+			l.Error("Down script does not fully revert the migration", fields, logger.Fields{"down": m.DownPath})
+			logSchemaDiff(l, before[i], after)
+			problems++
+		}
+	}
+
+	// Apply the reverted migrations again
+	for _, m := range migrations[reverted:] {
+		l.Info("Re-applying migration", logger.Fields{"version": m.Ver, "file": m.RelPath})
+		err = scratch.Apply(m)
+		if err != nil {
+			return problems, err
+		}
+	}
+	reapplied, err := snapshot(scratch)
+	if err != nil {
+		return problems, err
+	}
+	if reapplied != applied {
+		l.Error("Schema differs after re-applying the reverted migrations")
+		logSchemaDiff(l, applied, reapplied)
+		problems++
+	}
+	return problems, nil
+}
+
+// snapshot returns a dump of the database schema
+func snapshot(s *db.Session) (string, error) {
+	var buf bytes.Buffer
+	err := s.DumpSchema(&buf)
+	return buf.String(), err
+}
+
+// logSchemaDiff logs the DDL statements that are only found in one of the schema dumps
+func logSchemaDiff(l *logger.Logger, want string, got string) {
+	wantStmts := strings.Split(want, "\n\n")
+	gotStmts := strings.Split(got, "\n\n")
+	for _, s := range difference(wantStmts, gotStmts) {
+		l.Error("Missing from schema", logger.Fields{"statement": s})
+	}
+	for _, s := range difference(gotStmts, wantStmts) {
+		l.Error("Extra in schema", logger.Fields{"statement": s})
+	}
+}
+
+// difference returns the strings in a that are not found in b
+func difference(a []string, b []string) []string {
+	found := map[string]bool{}
+	for _, s := range b {
+		found[s] = true
+	}
+	var result []string
+	for _, s := range a {
+		if !found[s] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
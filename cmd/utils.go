@@ -1,14 +1,84 @@
 package cmd
 
 import (
-	"log"
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/quasoft/pgmig/db"
+	"github.com/quasoft/pgmig/logger"
+	"github.com/quasoft/pgmig/mig"
 
 	"github.com/spf13/cobra"
 )
 
+// log is the logger used by all commands, configured with --log-level and --log-format
+var log = logger.New(os.Stderr, logger.Info, logger.Text)
+var logLevel string
+var logFormat string
+
+// configureLog applies the --log-level and --log-format flags to the logger
+func configureLog(cmd *cobra.Command, args []string) {
+	level, err := logger.ParseLevel(logLevel)
+	if err != nil {
+		log.Error("Invalid --log-level", errFields(err))
+		os.Exit(1)
+	}
+	format, err := logger.ParseFormat(logFormat)
+	if err != nil {
+		log.Error("Invalid --log-format", errFields(err))
+		os.Exit(1)
+	}
+	log.Configure(level, format)
+}
+
+// errFields returns log fields for the error, including the SQLSTATE code of database errors
+func errFields(err error) logger.Fields {
+	fields := logger.Fields{"error": err}
+	if code := db.ErrorCode(err); code != "" {
+		fields["error_code"] = code
+	}
+	return fields
+}
+
+// targetLog returns a logger, which adds the target database of the session to all events
+func targetLog(s *db.Session) *logger.Logger {
+	return log.With(logger.Fields{"target": targetName(s)})
+}
+
+// runContext returns a context, which is cancelled on SIGINT or SIGTERM, or after the timeout, if not zero.
+// A second signal terminates the process immediately.
+func runContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		cancelAll := cancel
+		cancel = func() {
+			cancelTimeout()
+			cancelAll()
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sig:
+			log.Warn("Received signal, cancelling the run", logger.Fields{"signal": s.String()})
+			cancel()
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				log.Warn("Timeout exceeded, cancelling the run", logger.Fields{"timeout": timeout})
+			}
+		}
+		signal.Stop(sig)
+	}()
+	return ctx, cancel
+}
+
 func getFlagOrEnv(cmd *cobra.Command, flagName string, envName string) string {
 	// If flag has been set in command line arguments, use that
 	if cmd.Flags().Changed(flagName) {
@@ -16,7 +86,7 @@ func getFlagOrEnv(cmd *cobra.Command, flagName string, envName string) string {
 		if err == nil {
 			return value
 		}
-		log.Printf("could not get value for changed flag %s", flagName)
+		log.Warn("Could not get value for changed flag", logger.Fields{"flag": flagName})
 	}
 
 	// If corresponding environment variable has been set, use that
@@ -32,17 +102,59 @@ func getFlagOrEnv(cmd *cobra.Command, flagName string, envName string) string {
 	if err == nil {
 		return value
 	}
-	log.Printf("could not get default value for flag %s", flagName)
+	log.Warn("Could not get default value for flag", logger.Fields{"flag": flagName})
 
 	return ""
 }
 
+// addDirFlags adds flags for selecting the migration files to the command
+func addDirFlags(cmd *cobra.Command, d *mig.Dir) {
+	cmd.Flags().StringVarP(&d.Path, "dir", "D", "", "Local directory with migration scripts (default: current dir)")
+	cmd.Flags().BoolVarP(&d.Recursive, "recursive", "r", false, "Scan nested directories for migration scripts")
+	cmd.Flags().StringSliceVar(&d.IncludeDirs, "include-dir", nil, "Glob pattern for nested directories to scan (can be repeated)")
+	cmd.Flags().StringSliceVar(&d.ExcludeDirs, "exclude-dir", nil, "Glob pattern for nested directories to skip (can be repeated)")
+	cmd.Flags().StringSliceVar(&d.Include, "include", nil, "Glob pattern for names of migration files (can be repeated) (default: *.sql)")
+	cmd.Flags().StringSliceVar(&d.Exclude, "exclude", nil, "Glob pattern for names of files to ignore (can be repeated)")
+	cmd.Flags().BoolVar(&d.Strict, "strict", false, "Warn about ignored files that look like badly named migrations, and fail on down scripts without a migration")
+}
+
+// addConnectFlags adds flags for selecting the driver and waiting for the database to become available to the command
+func addConnectFlags(cmd *cobra.Command, s *db.Session) {
+	cmd.Flags().String("driver", db.AutoDriver, "Database driver to connect with (auto | pgx | pq), also set with PGMIG_DRIVER; auto selects pgx")
+	cmd.Flags().DurationVar(&s.Wait, "wait", 0, "Maximum time to keep retrying to connect while the database is not available, eg. 60s (default: fail on first error)")
+	cmd.Flags().DurationVar(&s.ConnectTimeout, "connect-timeout", 0, "Maximum duration of each connection attempt, eg. 5s (default: no limit)")
+}
+
+// connectRetryLogger returns a callback, which logs failed connection attempts before they are retried
+func connectRetryLogger(l *logger.Logger) func(int, time.Duration, error) {
+	return func(attempt int, delay time.Duration, err error) {
+		l.Warn("Database not available, retrying", logger.Fields{"attempt": attempt, "delay": delay.Round(time.Millisecond)}, errFields(err))
+	}
+}
+
+// noticeLogger returns a callback, which logs notices sent by the server, eg. by RAISE NOTICE in a migration
+func noticeLogger(l *logger.Logger) func(string, string) {
+	return func(severity, message string) {
+		l.Info("Server notice", logger.Fields{"severity": severity, "message": message})
+	}
+}
+
+// logDirWarnings logs the warnings produced while scanning the migrations directory
+func logDirWarnings(l *logger.Logger, d *mig.Dir) {
+	for _, w := range d.Warnings {
+		l.Warn(w)
+	}
+}
+
 func ParseFlagsOrEnv(s *db.Session, cmd *cobra.Command) {
 	s.Host = getFlagOrEnv(cmd, "host", "PGHOST")
 	s.Port = getFlagOrEnv(cmd, "port", "PGPORT")
 	s.Database = getFlagOrEnv(cmd, "database", "PGDATABASE")
 	s.Username = getFlagOrEnv(cmd, "username", "PGUSER")
 	s.SslMode = getFlagOrEnv(cmd, "ssl-mode", "PGSSLMODE")
+	s.Driver = getFlagOrEnv(cmd, "driver", "PGMIG_DRIVER")
+	s.OnConnectRetry = connectRetryLogger(targetLog(s))
+	s.OnNotice = noticeLogger(targetLog(s))
 	interactive, err := cmd.Flags().GetBool("interactive")
 	if err != nil {
 		s.Interactive = true
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+// batchSizePlaceholder is replaced with the batch size in the statement of a batched migration
+const batchSizePlaceholder = ":batch_size"
+
+// BatchProgress reports the progress of a batched data migration
+type BatchProgress struct {
+	Ver int
+	// Batches and Rows count the completed batches and the rows they affected, including
+	// the ones completed before an interruption
+	Batches int
+	Rows    int64
+	// Total is the estimated number of rows to process, or 0 if unknown
+	Total int64
+	// Elapsed is the time since the migration was started or resumed
+	Elapsed    time.Duration
+	RowsPerSec float64
+	// ETA is the estimated time left, or 0 if unknown
+	ETA  time.Duration
+	Done bool
+	// resumedRows is the number of rows processed before the migration was resumed
+	resumedRows int64
+}
+
+// update records a completed batch, which affected the given number of rows
+func (p *BatchProgress) update(rows int64, elapsed time.Duration) {
+	p.Batches++
+	p.Rows += rows
+	p.Elapsed = elapsed
+	if elapsed > 0 {
+		p.RowsPerSec = float64(p.Rows-p.resumedRows) / elapsed.Seconds()
+	}
+	p.ETA = 0
+	if p.Total > p.Rows && p.RowsPerSec > 0 {
+		p.ETA = time.Duration(float64(p.Total-p.Rows) / p.RowsPerSec * float64(time.Second))
+	}
+}
+
+// batchSQL returns the statement of a batched migration, with the batch size placeholder replaced
+func batchSQL(sql string, size int) string {
+	return strings.Replace(sql, batchSizePlaceholder, strconv.Itoa(size), -1)
+}
+
+// applyBatched runs the statement of a batched migration repeatedly, each time in a separate transaction,
+// until it affects no rows. The progress is stored in the changelog together with each batch, so that
+// an interrupted migration resumes counting from the last completed batch.
+func (s *Session) applyBatched(ctx context.Context, m mig.File, sql string) error {
+	p := BatchProgress{Ver: m.Ver}
+	store := s.store()
+	var err error
+	p.Batches, p.Rows, err = store.Progress(ctx, m.Ver)
+	if err != nil {
+		return fmt.Errorf("could not read progress of migration #%d from changelog: %v", m.Ver, err)
+	}
+	p.resumedRows = p.Rows
+
+	if m.Header.BatchEstimate != "" {
+		var left int64
+		err = s.db.QueryRowContext(ctx, m.Header.BatchEstimate).Scan(&left)
+		if err != nil {
+			return fmt.Errorf("could not estimate rows left for migration #%d: %v", m.Ver, err)
+		}
+		p.Total = p.Rows + left
+	}
+
+	stmt := batchSQL(sql, m.Header.BatchSize)
+	start := time.Now()
+	for {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("could not open transaction: %v", err)
+		}
+
+		err = s.setSettings(ctx, tx, m, true)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, stmt)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not execute batch %d of migration #%d from file %s: %w", p.Batches+1, m.Ver, m.FileName, err)
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not get number of rows affected by batch %d of migration #%d: %v", p.Batches+1, m.Ver, err)
+		}
+		err = s.resetRole(ctx, tx, m)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if rows == 0 {
+			err = s.complete(ctx, tx, m)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("could not mark migration #%d for file %s as completed in DB, rolling back...: %v", m.Ver, m.FileName, err)
+			}
+			err = tx.Commit()
+			if err == nil {
+				p.Done = true
+				p.Elapsed = time.Since(start)
+				s.reportBatch(p)
+			}
+			return err
+		}
+
+		err = store.AddBatch(ctx, tx, m.Ver, rows)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not record progress of migration #%d in changelog: %v", m.Ver, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("could not commit batch %d of migration #%d: %w", p.Batches+1, m.Ver, err)
+		}
+
+		p.update(rows, time.Since(start))
+		s.reportBatch(p)
+	}
+}
+
+// reportBatch passes the progress of a batched migration to the OnBatch callback, if set
+func (s *Session) reportBatch(p BatchProgress) {
+	if s.OnBatch != nil {
+		s.OnBatch(p)
+	}
+}
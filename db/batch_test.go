@@ -0,0 +1,125 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchSQL(t *testing.T) {
+	sql := "UPDATE person SET email = lower(email) WHERE id IN (SELECT id FROM person WHERE email <> lower(email) LIMIT :batch_size)"
+	want := "UPDATE person SET email = lower(email) WHERE id IN (SELECT id FROM person WHERE email <> lower(email) LIMIT 500)"
+	if got := batchSQL(sql, 500); got != want {
+		t.Errorf("batchSQL: got %q, want %q", got, want)
+	}
+}
+
+func TestBatchProgress(t *testing.T) {
+	// Resumed after 2 batches with 2000 rows, out of 10000
+	p := BatchProgress{Batches: 2, Rows: 2000, Total: 10000, resumedRows: 2000}
+	p.update(1000, 2*time.Second)
+	p.update(1000, 4*time.Second)
+
+	if p.Batches != 4 || p.Rows != 4000 {
+		t.Errorf("got %d batches and %d rows, want 4 and 4000", p.Batches, p.Rows)
+	}
+	if p.RowsPerSec != 500 {
+		t.Errorf("got %v rows per second, want 500", p.RowsPerSec)
+	}
+	if p.ETA != 12*time.Second {
+		t.Errorf("got ETA %v, want 12s", p.ETA)
+	}
+
+	// The ETA is unknown without an estimate of the total
+	p = BatchProgress{}
+	p.update(1000, time.Second)
+	if p.ETA != 0 {
+		t.Errorf("got ETA %v, want 0", p.ETA)
+	}
+}
+
+func TestApplyBatched(t *testing.T) {
+	d := testDir(t, "-- pgmig:batch-size 100\nUPDATE person SET email = lower(email) WHERE id IN (SELECT id FROM person LIMIT :batch_size)")
+	defer os.RemoveAll(d.Path)
+	migrations, err := d.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := migrations[0]
+
+	// Batches 1-3 update 100 rows each and batch 4 none. Batch 3 fails in the first run.
+	batch := 0
+	failBatch := 3
+	f := &fakeDB{
+		fail: func(query string) error {
+			if strings.Contains(query, "UPDATE person") && batch+1 == failBatch {
+				return errors.New("deadlock detected")
+			}
+			return nil
+		},
+		affected: func(query string) int64 {
+			if !strings.Contains(query, "UPDATE person") {
+				return 0
+			}
+			batch++
+			if batch <= 3 {
+				return 100
+			}
+			return 0
+		},
+	}
+	store := NewMemoryStore()
+	s := NewSessionFromDB(sql.OpenDB(f))
+	s.Store = store
+	s.Retries = 0
+	var progress []BatchProgress
+	s.OnBatch = func(p BatchProgress) { progress = append(progress, p) }
+
+	err = s.Apply(m)
+	if err == nil || !strings.Contains(err.Error(), "batch 3") {
+		t.Fatalf("Apply should have failed in batch 3, got %v", err)
+	}
+	if got := transactions(f.executed); !reflect.DeepEqual(got, []string{"UPDATE", "COMMIT", "UPDATE", "COMMIT", "ROLLBACK"}) {
+		t.Errorf("first run: got statements %q, want a commit per completed batch", got)
+	}
+	entries, _ := store.Entries()
+	if e := entries[0]; e.State || e.Batches != 2 || e.BatchRows != 200 {
+		t.Fatalf("first run: got entry %+v, want 2 batches with 200 rows, not applied", e)
+	}
+
+	// The second run resumes counting from the stored batches and rows
+	failBatch = 0
+	f.executed = nil
+	progress = nil
+	if err = s.Apply(m); err != nil {
+		t.Fatalf("second run: Apply returned error %v", err)
+	}
+	if got := transactions(f.executed); !reflect.DeepEqual(got, []string{"UPDATE", "COMMIT", "UPDATE", "COMMIT"}) {
+		t.Errorf("second run: got statements %q, want the remaining batch and the final empty one", got)
+	}
+	if len(progress) != 2 || progress[0].Batches != 3 || progress[0].Rows != 300 || progress[0].resumedRows != 200 || !progress[1].Done {
+		t.Errorf("second run: got progress %+v, want batch 3 with 300 rows, then done", progress)
+	}
+	entries, _ = store.Entries()
+	if e := entries[0]; !e.State || e.Status != "applied" || e.Batches != 3 || e.BatchRows != 300 {
+		t.Errorf("second run: got entry %+v, want applied with 3 batches and 300 rows", e)
+	}
+}
+
+// transactions returns the batch statements, commits and rollbacks of the executed statements
+func transactions(executed []string) []string {
+	var got []string
+	for _, q := range executed {
+		switch {
+		case strings.Contains(q, "UPDATE person"):
+			got = append(got, "UPDATE")
+		case q == "COMMIT" || q == "ROLLBACK":
+			got = append(got, q)
+		}
+	}
+	return got
+}
@@ -0,0 +1,346 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+// Entry is a row of the changelog table
+type Entry struct {
+	Version   int       `json:"version"`
+	FileName  string    `json:"file_name"`
+	AppliedBy string    `json:"applied_by"`
+	DateTime  time.Time `json:"date_time"`
+	// State is true if the migration was applied successfully
+	State     bool   `json:"state"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+	// Status is "applied" or "skipped" for completed migrations, "interrupted" for migrations
+	// interrupted by cancellation, or empty
+	Status string `json:"status,omitempty"`
+	// Batches and BatchRows hold the progress of batched migrations
+	Batches   int   `json:"batches,omitempty"`
+	BatchRows int64 `json:"batch_rows,omitempty"`
+	// AppliedAs is the role the migration was applied as and Settings the run-time parameters
+	// it was applied with, as a comma separated list of name=value pairs
+	AppliedAs string `json:"applied_as,omitempty"`
+	Settings  string `json:"settings,omitempty"`
+}
+
+// Changelog returns all entries of the changelog, sorted by version
+func (s *Session) Changelog() ([]Entry, error) {
+	return s.store().Entries()
+}
+
+// Conflict is what ImportEntries does with entries of migrations already in the changelog
+type Conflict int
+
+const (
+	// FailOnConflict imports nothing if any of the migrations is already in the changelog
+	FailOnConflict Conflict = iota
+	// ReplaceOnConflict replaces the existing entries
+	ReplaceOnConflict
+	// SkipOnConflict keeps the existing entries and imports the others
+	SkipOnConflict
+)
+
+// ImportEntries adds the entries to the changelog, handling entries of migrations already in the
+// changelog as given by onConflict. The changelog table is checked and written in a single transaction,
+// which locks the table against concurrent changes. Returns the versions of the entries that were
+// already in the changelog.
+func (s *Session) ImportEntries(entries []Entry, onConflict Conflict) ([]int, error) {
+	ctx := context.Background()
+	if s.Store != nil {
+		existing, err := s.Store.Entries()
+		if err != nil {
+			return nil, err
+		}
+		versions := map[int]bool{}
+		for _, e := range existing {
+			versions[e.Version] = true
+		}
+		return putEntries(ctx, s.Store, nil, versions, entries, onConflict)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Block migrations from changing the table between the check and the import
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`LOCK TABLE "%s" IN SHARE ROW EXCLUSIVE MODE`, sanitizeIdentifier(s.ChangelogName)))
+	if err != nil {
+		return nil, fmt.Errorf("could not lock changelog table %s: %v", s.ChangelogName, err)
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT version FROM "%s"`, sanitizeIdentifier(s.ChangelogName)))
+	if err != nil {
+		return nil, fmt.Errorf("could not read changelog table %s: %v", s.ChangelogName, err)
+	}
+	versions := map[int]bool{}
+	for rows.Next() {
+		var ver int
+		if err = rows.Scan(&ver); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not read changelog table %s: %v", s.ChangelogName, err)
+		}
+		versions[ver] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read changelog table %s: %v", s.ChangelogName, err)
+	}
+
+	conflicts, err := putEntries(ctx, s.store(), tx, versions, entries, onConflict)
+	if err != nil {
+		return conflicts, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return conflicts, fmt.Errorf("could not commit transaction: %v", err)
+	}
+	return conflicts, nil
+}
+
+// putEntries writes the entries to the store, handling the entries in existing as given by onConflict.
+// Returns the versions of the entries in existing.
+func putEntries(ctx context.Context, store Store, ex Execer, existing map[int]bool, entries []Entry, onConflict Conflict) ([]int, error) {
+	var conflicts []int
+	for _, e := range entries {
+		if existing[e.Version] {
+			conflicts = append(conflicts, e.Version)
+		}
+	}
+	if len(conflicts) > 0 && onConflict == FailOnConflict {
+		return conflicts, fmt.Errorf("%d of the migrations are already in the changelog", len(conflicts))
+	}
+	for _, e := range entries {
+		if existing[e.Version] && onConflict == SkipOnConflict {
+			continue
+		}
+		err := store.Put(ctx, ex, e)
+		if err != nil {
+			return conflicts, err
+		}
+	}
+	return conflicts, nil
+}
+
+// store returns the changelog store of the session: Store, if set, or the changelog table
+func (s *Session) store() Store {
+	if s.Store != nil {
+		return s.Store
+	}
+	return &tableStore{db: s.db, name: s.ChangelogName}
+}
+
+// tableStore keeps the changelog in a table of the migrated database
+type tableStore struct {
+	db   *sql.DB
+	name string
+}
+
+// Entries returns all rows of the changelog table, sorted by version. Tables created by older
+// versions of pgmig, which lack some of the columns, are read without upgrading them.
+func (st *tableStore) Entries() ([]Entry, error) {
+	// Columns added by UpgradeChangelog are read through to_jsonb, so that the query does not fail if they are missing
+	query := fmt.Sprintf(
+		`SELECT version, file_name, applied_by, date_time, state,
+			COALESCE((to_jsonb(c)->>'attempts')::int, 0), COALESCE(to_jsonb(c)->>'last_error', ''),
+			COALESCE(to_jsonb(c)->>'status', ''),
+			COALESCE((to_jsonb(c)->>'batches')::int, 0), COALESCE((to_jsonb(c)->>'batch_rows')::bigint, 0),
+			COALESCE(to_jsonb(c)->>'applied_as', ''), COALESCE(to_jsonb(c)->>'settings', '')
+		FROM "%s" c ORDER BY version`,
+		sanitizeIdentifier(st.name),
+	)
+	rows, err := st.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("could not read changelog table %s: %v", st.name, err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		var appliedBy sql.NullString
+		err = rows.Scan(&e.Version, &e.FileName, &appliedBy, &e.DateTime, &e.State, &e.Attempts, &e.LastError, &e.Status, &e.Batches, &e.BatchRows, &e.AppliedAs, &e.Settings)
+		if err != nil {
+			return nil, fmt.Errorf("could not read changelog table %s: %v", st.name, err)
+		}
+		e.AppliedBy = appliedBy.String
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read changelog table %s: %v", st.name, err)
+	}
+	return entries, nil
+}
+
+// LastApplied returns the version of the last migration file that was applied successfully,
+// according to the changelog table
+func (st *tableStore) LastApplied() (int, error) {
+	query := fmt.Sprintf(
+		`SELECT COALESCE(MAX(version), 0) FROM "%s" WHERE state = true`,
+		sanitizeIdentifier(st.name),
+	)
+	var migVer int
+	err := st.db.QueryRow(query).Scan(&migVer)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not get version of last migration from changelog table: %v", err)
+	}
+
+	return migVer, nil
+}
+
+// Applied checks if the specified migration was applied to DB
+func (st *tableStore) Applied(migVer int) (bool, error) {
+	query := fmt.Sprintf(
+		`SELECT COUNT(*) FROM "%s" WHERE state = true AND version = $1`,
+		sanitizeIdentifier(st.name),
+	)
+	var cnt int
+	err := st.db.QueryRow(query, migVer).Scan(&cnt)
+	if err != nil {
+		return false, fmt.Errorf("could not check in changelog %s if migration #%d was applied: %v", st.name, migVer, err)
+	}
+
+	return cnt > 0, nil
+}
+
+// Failed checks if the specified migration is in failed state
+func (st *tableStore) Failed(migVer int) (bool, error) {
+	query := fmt.Sprintf(
+		`SELECT COUNT(*) FROM "%s" WHERE state = false AND version = $1`,
+		sanitizeIdentifier(st.name),
+	)
+	var cnt int
+	err := st.db.QueryRow(query, migVer).Scan(&cnt)
+	if err != nil {
+		return false, fmt.Errorf("could not check in changelog %s if migration #%d failed: %v", st.name, migVer, err)
+	}
+
+	return cnt > 0, nil
+}
+
+// Insert records the migration in the changelog
+func (st *tableStore) Insert(m mig.File) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (version, file_name) VALUES($1, $2)`,
+		sanitizeIdentifier(st.name),
+	)
+	_, err := st.db.Exec(query, m.Ver, m.FileName)
+	return err
+}
+
+// Attempt increments the number of attempts to apply the migration in the changelog
+func (st *tableStore) Attempt(migVer int) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET attempts = attempts + 1 WHERE version = $1`,
+		sanitizeIdentifier(st.name),
+	)
+	_, err := st.db.Exec(query, migVer)
+	return err
+}
+
+// Fail records the error from the last attempt to apply the migration in the changelog
+func (st *tableStore) Fail(migVer int, migErr error) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET last_error = $1, status = NULL WHERE version = $2`,
+		sanitizeIdentifier(st.name),
+	)
+	_, err := st.db.Exec(query, migErr.Error(), migVer)
+	return err
+}
+
+// Interrupt records in the changelog that applying the migration was interrupted
+func (st *tableStore) Interrupt(migVer int, migErr error) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET last_error = $1, status = $2 WHERE version = $3`,
+		sanitizeIdentifier(st.name),
+	)
+	_, err := st.db.Exec(query, migErr.Error(), string(StateInterrupted), migVer)
+	return err
+}
+
+// Skip records the migration in the changelog as skipped
+func (st *tableStore) Skip(m mig.File) error {
+	query := fmt.Sprintf(
+		`INSERT INTO "%s" (version, file_name, state, status) VALUES ($1, $2, true, $3)
+		ON CONFLICT (version) DO UPDATE SET file_name = EXCLUDED.file_name, state = true, status = EXCLUDED.status, last_error = NULL`,
+		sanitizeIdentifier(st.name),
+	)
+	_, err := st.db.Exec(query, m.Ver, m.FileName, string(StateSkipped))
+	return err
+}
+
+// Complete marks the migration as applied in the changelog, together with the role
+// and the settings it was applied with
+func (st *tableStore) Complete(ctx context.Context, ex Execer, migVer int, appliedAs string, settings string) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET state = true, status = $2, last_error = NULL,
+			applied_as = COALESCE(NULLIF($3, ''), current_user), settings = NULLIF($4, '')
+		WHERE version = $1`,
+		sanitizeIdentifier(st.name),
+	)
+	_, err := ex.ExecContext(ctx, query, migVer, string(StateApplied), appliedAs, settings)
+	return err
+}
+
+// Progress returns the number of completed batches and rows of a batched migration
+func (st *tableStore) Progress(ctx context.Context, migVer int) (int, int64, error) {
+	query := fmt.Sprintf(
+		`SELECT batches, batch_rows FROM "%s" WHERE version = $1`,
+		sanitizeIdentifier(st.name),
+	)
+	var batches int
+	var rows int64
+	err := st.db.QueryRowContext(ctx, query, migVer).Scan(&batches, &rows)
+	return batches, rows, err
+}
+
+// AddBatch records a completed batch of a batched migration in the changelog
+func (st *tableStore) AddBatch(ctx context.Context, ex Execer, migVer int, rows int64) error {
+	query := fmt.Sprintf(
+		`UPDATE "%s" SET batches = batches + 1, batch_rows = batch_rows + $1 WHERE version = $2`,
+		sanitizeIdentifier(st.name),
+	)
+	_, err := ex.ExecContext(ctx, query, rows, migVer)
+	return err
+}
+
+// Remove deletes the migration from the changelog
+func (st *tableStore) Remove(ctx context.Context, ex Execer, migVer int) error {
+	query := fmt.Sprintf(
+		`DELETE FROM "%s" WHERE version = $1`,
+		sanitizeIdentifier(st.name),
+	)
+	_, err := ex.ExecContext(ctx, query, migVer)
+	return err
+}
+
+// Put adds the row or replaces the row with the same version in the changelog table.
+// An empty AppliedBy is stored as is, so that exported changelogs are imported unchanged.
+func (st *tableStore) Put(ctx context.Context, ex Execer, e Entry) error {
+	query := fmt.Sprintf(
+		`INSERT INTO "%s" (version, file_name, applied_by, date_time, state, attempts, last_error, status, batches, batch_rows, applied_as, settings)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9, $10, NULLIF($11, ''), NULLIF($12, ''))
+		ON CONFLICT (version) DO UPDATE SET file_name = EXCLUDED.file_name, applied_by = EXCLUDED.applied_by,
+			date_time = EXCLUDED.date_time, state = EXCLUDED.state, attempts = EXCLUDED.attempts, last_error = EXCLUDED.last_error,
+			status = EXCLUDED.status, batches = EXCLUDED.batches, batch_rows = EXCLUDED.batch_rows,
+			applied_as = EXCLUDED.applied_as, settings = EXCLUDED.settings`,
+		sanitizeIdentifier(st.name),
+	)
+	_, err := ex.ExecContext(ctx, query, e.Version, e.FileName, e.AppliedBy, e.DateTime.UTC(), e.State, e.Attempts, e.LastError,
+		e.Status, e.Batches, e.BatchRows, e.AppliedAs, e.Settings)
+	if err != nil {
+		return fmt.Errorf("could not write migration #%d to changelog table %s: %v", e.Version, st.name, err)
+	}
+	return nil
+}
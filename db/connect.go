@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// maxConnectDelay is the longest delay between connection attempts while waiting for the database
+const maxConnectDelay = 10 * time.Second
+
+// ConnectContext is like Connect, but if Wait is set, retries connecting with exponential backoff
+// while the database is not available yet (eg. the server is not listening or is starting up).
+// Permanent errors, like a wrong password or an unknown database, fail immediately.
+func (s *Session) ConnectContext(ctx context.Context) error {
+	start := time.Now()
+	delay := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := s.connect(ctx)
+		if err == nil {
+			return nil
+		}
+		if s.Wait <= 0 || !isTransient(err) || ctx.Err() != nil {
+			return err
+		}
+
+		left := s.Wait - time.Since(start)
+		if left <= 0 {
+			return fmt.Errorf("database not available after waiting %s: %w", s.Wait, err)
+		}
+		if delay > left {
+			delay = left
+		}
+		if s.OnConnectRetry != nil {
+			s.OnConnectRetry(attempt, delay, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+		if delay > maxConnectDelay {
+			delay = maxConnectDelay
+		}
+	}
+}
+
+// connect makes a single attempt to connect to the database and ping it, limited by ConnectTimeout
+// Sessions created from an existing connection pool only ping it.
+func (s *Session) connect(ctx context.Context) error {
+	db := s.db
+	if db == nil {
+		driver, err := LookupDriver(s.Driver)
+		if err != nil {
+			return err
+		}
+
+		// Build connection string
+		s.ResolvePassword()
+		connStr := buildConnString(s.Host, s.Port, s.Database, s.Username, s.Password, s.SslMode, s.Schema)
+
+		// Open connection
+		db, err = driver.Open(connStr, s.OnNotice)
+		if err != nil {
+			return fmt.Errorf("could not open DB connection: %w", err)
+		}
+	}
+
+	if s.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ConnectTimeout)
+		defer cancel()
+	}
+
+	// Test DB connection (ping)
+	var dummy string
+	err := db.QueryRowContext(ctx, "SELECT 1;").Scan(&dummy)
+	if err != nil || dummy != "1" {
+		if db != s.db {
+			db.Close()
+		}
+		return fmt.Errorf("could not ping DB: %w", err)
+	}
+	s.db = db
+
+	return nil
+}
+
+// transientCodes are the SQLSTATE codes of errors, after which connecting again may succeed
+var transientCodes = map[string]bool{
+	"57P03": true, // cannot_connect_now: the database system is starting up
+	"53300": true, // too_many_connections
+	"08000": true, // connection_exception
+	"08001": true, // sqlclient_unable_to_establish_sqlconnection
+	"08006": true, // connection_failure
+}
+
+// isTransient checks if the connection error may go away by itself, like a refused connection
+// or a server that is starting up. Errors like a failed authentication (28P01, 28000) or an
+// unknown database (3D000) are permanent.
+func isTransient(err error) bool {
+	if code := ErrorCode(err); code != "" {
+		return transientCodes[code]
+	}
+
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// The server closed the connection during startup or shutdown
+		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		// The attempt took longer than the connect timeout
+		return true
+	case errors.As(err, &dnsErr):
+		// The host name may not be registered yet, eg. for a new container
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
+)
+
+func TestIsTransient(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}
+
+	var tests = []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", fmt.Errorf("could not ping DB: %w", refused), true},
+		{"starting up", fmt.Errorf("could not ping DB: %w", &pq.Error{Code: "57P03", Message: "the database system is starting up"}), true},
+		{"too many connections", &pq.Error{Code: "53300"}, true},
+		{"connection closed", fmt.Errorf("could not ping DB: %w", io.EOF), true},
+		{"connect timeout", fmt.Errorf("could not ping DB: %w", context.DeadlineExceeded), true},
+		{"unknown host", &net.DNSError{Err: "no such host", Name: "db"}, true},
+		{"wrong password", fmt.Errorf("could not ping DB: %w", &pq.Error{Code: "28P01"}), false},
+		{"no access", &pq.Error{Code: "28000"}, false},
+		{"unknown database", &pq.Error{Code: "3D000"}, false},
+		{"starting up (pgx)", fmt.Errorf("could not ping DB: %w", &pgconn.PgError{Code: "57P03"}), true},
+		{"wrong password (pgx)", &pgconn.PgError{Code: "28P01"}, false},
+		{"other error", errors.New("pq: unknown sslmode"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%s): got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
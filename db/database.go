@@ -0,0 +1,115 @@
+package db
+
+import (
+	"fmt"
+)
+
+// DatabaseOptions holds the settings for creating a new database
+type DatabaseOptions struct {
+	// Template is the name of the database to copy (default: template1, or template0 if Encoding or
+	// Locale is set, as template1 may have a different encoding and locale)
+	Template string
+	// Owner is the role owning the new database (default: the current user)
+	Owner string
+	// Encoding is the character set of the new database, eg. UTF8
+	Encoding string
+	// Locale sets the collation and character classification of the new database, eg. en_US.UTF-8
+	Locale string
+}
+
+// createDatabaseSQL returns the statement creating a database with the given options
+func createDatabaseSQL(name string, opts DatabaseOptions) string {
+	sql := "CREATE DATABASE " + quoteIdentifier(name)
+	if opts.Owner != "" {
+		sql += " OWNER " + quoteIdentifier(opts.Owner)
+	}
+	template := opts.Template
+	if template == "" && (opts.Encoding != "" || opts.Locale != "") {
+		template = "template0"
+	}
+	if template != "" {
+		sql += " TEMPLATE " + quoteIdentifier(template)
+	}
+	if opts.Encoding != "" {
+		sql += " ENCODING " + quoteString(opts.Encoding)
+	}
+	if opts.Locale != "" {
+		sql += fmt.Sprintf(" LC_COLLATE %s LC_CTYPE %s", quoteString(opts.Locale), quoteString(opts.Locale))
+	}
+	return sql
+}
+
+// CreateDatabase creates a new database on the server of the session
+func (s *Session) CreateDatabase(name string, opts DatabaseOptions) error {
+	_, err := s.db.Exec(createDatabaseSQL(name, opts))
+	if err != nil {
+		return fmt.Errorf("could not create database %s: %v", name, err)
+	}
+	return nil
+}
+
+// DropDatabase drops the database from the server of the session, if it exists
+func (s *Session) DropDatabase(name string) error {
+	_, err := s.db.Exec("DROP DATABASE IF EXISTS " + quoteIdentifier(name))
+	if err != nil {
+		return fmt.Errorf("could not drop database %s: %v", name, err)
+	}
+	return nil
+}
+
+// DatabaseExists checks if a database with the given name exists on the server of the session
+func (s *Session) DatabaseExists(name string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`, name).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("could not check if database %s exists: %v", name, err)
+	}
+	return exists, nil
+}
+
+// RoleExists checks if a role with the given name exists on the server of the session
+func (s *Session) RoleExists(name string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)`, name).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("could not check if role %s exists: %v", name, err)
+	}
+	return exists, nil
+}
+
+// CreateRole creates a role, which can log in with the given password. Without a password,
+// the role can only log in with other authentication methods (eg. peer or certificates).
+func (s *Session) CreateRole(name string, password string) error {
+	sql := "CREATE ROLE " + quoteIdentifier(name) + " LOGIN"
+	if password != "" {
+		sql += " PASSWORD " + quoteString(password)
+	}
+	_, err := s.db.Exec(sql)
+	if err != nil {
+		return fmt.Errorf("could not create role %s: %v", name, err)
+	}
+	return nil
+}
+
+// GrantMigrationRole grants the role the privileges needed to apply migrations to the database of
+// the session, without making it a superuser: connecting to the database, creating objects in the
+// current schema and owning the changelog table. The changelog table must exist.
+func (s *Session) GrantMigrationRole(role string) error {
+	var schema string
+	err := s.db.QueryRow("SELECT current_schema()").Scan(&schema)
+	if err != nil {
+		return fmt.Errorf("could not grant privileges to role %s: %v", role, err)
+	}
+	statements := []string{
+		fmt.Sprintf("GRANT CONNECT, TEMPORARY, CREATE ON DATABASE %s TO %s", quoteIdentifier(s.Database), quoteIdentifier(role)),
+		fmt.Sprintf("GRANT USAGE, CREATE ON SCHEMA %s TO %s", quoteIdentifier(schema), quoteIdentifier(role)),
+		fmt.Sprintf(`ALTER TABLE "%s" OWNER TO %s`, sanitizeIdentifier(s.ChangelogName), quoteIdentifier(role)),
+	}
+	for _, sql := range statements {
+		_, err = s.db.Exec(sql)
+		if err != nil {
+			return fmt.Errorf("could not grant privileges to role %s: %v", role, err)
+		}
+	}
+	return nil
+}
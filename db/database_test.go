@@ -0,0 +1,24 @@
+package db
+
+import "testing"
+
+func TestCreateDatabaseSQL(t *testing.T) {
+	var tests = []struct {
+		name string
+		opts DatabaseOptions
+		want string
+	}{
+		{"app", DatabaseOptions{}, `CREATE DATABASE "app"`},
+		{"app", DatabaseOptions{Template: "app_template"}, `CREATE DATABASE "app" TEMPLATE "app_template"`},
+		{"app", DatabaseOptions{Owner: "app_owner", Encoding: "UTF8", Locale: "en_US.UTF-8"},
+			`CREATE DATABASE "app" OWNER "app_owner" TEMPLATE "template0" ENCODING 'UTF8' LC_COLLATE 'en_US.UTF-8' LC_CTYPE 'en_US.UTF-8'`},
+		{`app"; DROP`, DatabaseOptions{Encoding: "UTF8'"}, `CREATE DATABASE "app""; DROP" TEMPLATE "template0" ENCODING 'UTF8'''`},
+		{"my-app", DatabaseOptions{Owner: "my-app owner"}, `CREATE DATABASE "my-app" OWNER "my-app owner"`},
+	}
+
+	for _, tt := range tests {
+		if got := createDatabaseSQL(tt.name, tt.opts); got != tt.want {
+			t.Errorf("createDatabaseSQL(%q, %+v): got %s, want %s", tt.name, tt.opts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	"github.com/lib/pq"
+)
+
+// Driver opens connection pools to PostgreSQL through one of the database/sql drivers
+type Driver interface {
+	// Name is the name the driver is selected with, eg. "pgx"
+	Name() string
+	// Open returns a connection pool for the connection string, without connecting.
+	// onNotice, if not nil, is called for each notice sent by the server (eg. RAISE NOTICE).
+	Open(connStr string, onNotice func(severity, message string)) (*sql.DB, error)
+}
+
+// drivers lists the supported drivers by name
+var drivers = map[string]Driver{
+	"pgx": pgxDriver{},
+	"pq":  pqDriver{},
+}
+
+// AutoDriver is the name of the default driver selection, which uses pgx
+const AutoDriver = "auto"
+
+// LookupDriver returns the driver with the given name ("pgx" or "pq").
+// An empty name or "auto" selects pgx.
+func LookupDriver(name string) (Driver, error) {
+	if name == "" || name == AutoDriver {
+		name = "pgx"
+	}
+	d, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown driver %q, expected auto, pgx or pq", name)
+	}
+	return d, nil
+}
+
+// pgxDriver uses github.com/jackc/pgx through its database/sql adapter
+type pgxDriver struct{}
+
+func (pgxDriver) Name() string {
+	return "pgx"
+}
+
+func (pgxDriver) Open(connStr string, onNotice func(severity, message string)) (*sql.DB, error) {
+	config, err := pgx.ParseConfig(connStr)
+	if err != nil {
+		return nil, err
+	}
+	if onNotice != nil {
+		config.OnNotice = func(_ *pgconn.PgConn, n *pgconn.Notice) {
+			onNotice(n.Severity, n.Message)
+		}
+	}
+	return stdlib.OpenDB(*config), nil
+}
+
+// pqDriver uses github.com/lib/pq
+type pqDriver struct{}
+
+func (pqDriver) Name() string {
+	return "pq"
+}
+
+func (pqDriver) Open(connStr string, onNotice func(severity, message string)) (*sql.DB, error) {
+	connector, err := pq.NewConnector(connStr)
+	if err != nil {
+		return nil, err
+	}
+	if onNotice == nil {
+		return sql.OpenDB(connector), nil
+	}
+	return sql.OpenDB(pq.ConnectorWithNoticeHandler(connector, func(n *pq.Error) {
+		onNotice(n.Severity, n.Message)
+	})), nil
+}
+
+// NewSessionFromDB creates a session using an existing connection pool, opened with any PostgreSQL
+// driver for database/sql. The pool stays open on Disconnect and is not shared by clones of the session.
+func NewSessionFromDB(db *sql.DB) *Session {
+	s := NewSession()
+	s.db = db
+	s.sharedDB = true
+	return s
+}
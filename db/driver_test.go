@@ -0,0 +1,84 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestLookupDriver(t *testing.T) {
+	var tests = []struct {
+		name    string
+		want    string
+		noError bool
+	}{
+		{"", "pgx", true},
+		{"auto", "pgx", true},
+		{"pgx", "pgx", true},
+		{"pq", "pq", true},
+		{"mysql", "", false},
+	}
+
+	for _, tt := range tests {
+		d, err := LookupDriver(tt.name)
+		if err != nil {
+			if tt.noError {
+				t.Errorf("LookupDriver(%q) returned error %v", tt.name, err)
+			}
+			continue
+		}
+		if !tt.noError {
+			t.Errorf("LookupDriver(%q) should have returned an error", tt.name)
+			continue
+		}
+		if d.Name() != tt.want {
+			t.Errorf("LookupDriver(%q): got %s, want %s", tt.name, d.Name(), tt.want)
+		}
+	}
+}
+
+func TestDriverOpen(t *testing.T) {
+	connStr := buildConnString("localhost", "5432", "testdb", "postgres", "secret", "disable", "tenant_1")
+	for name, d := range drivers {
+		db, err := d.Open(connStr, func(string, string) {})
+		if err != nil {
+			t.Errorf("%s: Open(%q) returned error %v", name, connStr, err)
+			continue
+		}
+		db.Close()
+	}
+}
+
+// fakeDriver opens pools connecting to the fake database
+type fakeDriver struct{ db *fakeDB }
+
+func (d fakeDriver) Name() string { return "fake" }
+func (d fakeDriver) Open(connStr string, onNotice func(severity, message string)) (*sql.DB, error) {
+	return sql.OpenDB(d.db), nil
+}
+
+func TestReconnect(t *testing.T) {
+	drivers["fake"] = fakeDriver{&fakeDB{}}
+	defer delete(drivers, "fake")
+
+	s := NewSession()
+	s.Driver = "fake"
+	for i := 1; i <= 2; i++ {
+		if err := s.Connect(); err != nil {
+			t.Fatalf("Connect() #%d returned error %v", i, err)
+		}
+		if err := s.Disconnect(); err != nil {
+			t.Fatalf("Disconnect() #%d returned error %v", i, err)
+		}
+	}
+
+	// Pools passed in by the caller are not closed
+	pool := sql.OpenDB(&fakeDB{})
+	defer pool.Close()
+	s = NewSessionFromDB(pool)
+	for i := 1; i <= 2; i++ {
+		if err := s.Connect(); err != nil {
+			t.Fatalf("NewSessionFromDB: Connect() #%d returned error %v", i, err)
+		}
+		s.Disconnect()
+	}
+}
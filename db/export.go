@@ -0,0 +1,165 @@
+package db
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+// Format is a file format for exporting and importing the changelog
+type Format string
+
+const (
+	JSON Format = "json"
+	CSV  Format = "csv"
+)
+
+// csvColumns are the columns of exported CSV files, named like the columns of the changelog table
+var csvColumns = []string{"version", "file_name", "applied_by", "date_time", "state", "attempts", "last_error", "status", "batches", "batch_rows", "applied_as", "settings"}
+
+// ParseFormat returns the format with the given name. If name is empty, the format is chosen by the
+// extension of the file at path, defaulting to JSON.
+func ParseFormat(name string, path string) (Format, error) {
+	if name == "" {
+		name = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		if name != string(CSV) {
+			name = string(JSON)
+		}
+	}
+	switch Format(name) {
+	case JSON, CSV:
+		return Format(name), nil
+	}
+	return "", fmt.Errorf("unknown format %q, expected json or csv", name)
+}
+
+// WriteEntries writes the changelog entries to w in the given format. JSON is written as an array
+// of entries, which can be read by NewFileStore.
+func WriteEntries(w io.Writer, entries []Entry, format Format) error {
+	if format == CSV {
+		return writeCSV(w, entries)
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+	bytes, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode changelog: %v", err)
+	}
+	_, err = w.Write(append(bytes, '\n'))
+	return err
+}
+
+func writeCSV(w io.Writer, entries []Entry) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvColumns)
+	for _, e := range entries {
+		cw.Write([]string{
+			strconv.Itoa(e.Version), e.FileName, e.AppliedBy, e.DateTime.Format(time.RFC3339Nano),
+			strconv.FormatBool(e.State), strconv.Itoa(e.Attempts), e.LastError, e.Status,
+			strconv.Itoa(e.Batches), strconv.FormatInt(e.BatchRows, 10), e.AppliedAs, e.Settings,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadEntries reads changelog entries written by WriteEntries in the given format
+func ReadEntries(r io.Reader, format Format) ([]Entry, error) {
+	if format == CSV {
+		return readCSV(r)
+	}
+	var entries []Entry
+	err := json.NewDecoder(r).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse changelog: %v", err)
+	}
+	return entries, nil
+}
+
+func readCSV(r io.Reader) ([]Entry, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse changelog: %v", err)
+	}
+	if len(records) == 0 || strings.Join(records[0], ",") != strings.Join(csvColumns, ",") {
+		return nil, fmt.Errorf("could not parse changelog: the first line should list the columns %s", strings.Join(csvColumns, ","))
+	}
+
+	var entries []Entry
+	for i, rec := range records[1:] {
+		var e Entry
+		var errs []error
+		parseInt := func(s string) int {
+			n, err := strconv.Atoi(s)
+			errs = append(errs, err)
+			return n
+		}
+		e.Version = parseInt(rec[0])
+		e.FileName, e.AppliedBy = rec[1], rec[2]
+		e.DateTime, err = time.Parse(time.RFC3339Nano, rec[3])
+		errs = append(errs, err)
+		e.State, err = strconv.ParseBool(rec[4])
+		errs = append(errs, err)
+		e.Attempts = parseInt(rec[5])
+		e.LastError, e.Status = rec[6], rec[7]
+		e.Batches = parseInt(rec[8])
+		e.BatchRows, err = strconv.ParseInt(rec[9], 10, 64)
+		errs = append(errs, err)
+		e.AppliedAs, e.Settings = rec[10], rec[11]
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("could not parse line %d of changelog: %v", i+2, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// ValidateEntries checks that each entry matches a migration file with the same version and file name,
+// or is replaced by a baseline migration (see mig.Header.ReplacesFrom), and that no version is repeated.
+// Returns an error for each invalid entry.
+func ValidateEntries(entries []Entry, migrations []mig.File) []error {
+	byVer := map[int]mig.File{}
+	for _, m := range migrations {
+		byVer[m.Ver] = m
+	}
+
+	var errs []error
+	seen := map[int]bool{}
+	for _, e := range entries {
+		if seen[e.Version] {
+			errs = append(errs, fmt.Errorf("migration #%d is listed more than once", e.Version))
+			continue
+		}
+		seen[e.Version] = true
+
+		m, ok := byVer[e.Version]
+		// A baseline has the version of the last migration it replaces, but a different name
+		if ok && m.FileName != e.FileName && m.Header.ReplacesTo == 0 {
+			errs = append(errs, fmt.Errorf("migration #%d is recorded as %s, but the file is named %s", e.Version, e.FileName, m.FileName))
+		}
+		if !ok && !replaced(e.Version, migrations) {
+			errs = append(errs, fmt.Errorf("migration #%d (%s) has no migration file", e.Version, e.FileName))
+		}
+	}
+	return errs
+}
+
+// replaced checks if the version is replaced by one of the baseline migrations
+func replaced(ver int, migrations []mig.File) bool {
+	for _, m := range migrations {
+		if m.Header.ReplacesTo > 0 && ver >= m.Header.ReplacesFrom && ver <= m.Header.ReplacesTo {
+			return true
+		}
+	}
+	return false
+}
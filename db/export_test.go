@@ -0,0 +1,84 @@
+package db
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+func TestReadWriteEntries(t *testing.T) {
+	at := time.Date(2020, 5, 1, 12, 30, 0, 500, time.UTC)
+	entries := []Entry{
+		{Version: 1, FileName: "0001_Create_users.sql", AppliedBy: "postgres", DateTime: at, State: true, Attempts: 1, Status: "applied", AppliedAs: "app_owner", Settings: "work_mem=1GB, lock_timeout=5s"},
+		{Version: 2, FileName: "0002_Backfill.sql", AppliedBy: "postgres", DateTime: at, Attempts: 3, LastError: "could not execute migration #2:\n\"deadlock\"", Batches: 10, BatchRows: 100000},
+	}
+
+	for _, format := range []Format{JSON, CSV} {
+		var buf bytes.Buffer
+		if err := WriteEntries(&buf, entries, format); err != nil {
+			t.Fatalf("WriteEntries(%s) returned error %v", format, err)
+		}
+		got, err := ReadEntries(&buf, format)
+		if err != nil {
+			t.Fatalf("ReadEntries(%s) returned error %v", format, err)
+		}
+		if !reflect.DeepEqual(got, entries) {
+			t.Errorf("%s: got %+v, want %+v", format, got, entries)
+		}
+	}
+
+	_, err := ReadEntries(strings.NewReader("version,file_name\n1,0001_Create_users.sql\n"), CSV)
+	if err == nil {
+		t.Errorf("ReadEntries should fail for CSV with unexpected columns")
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	var tests = []struct {
+		name    string
+		path    string
+		want    Format
+		noError bool
+	}{
+		{"", "changelog.csv", CSV, true},
+		{"", "changelog.json", JSON, true},
+		{"", "", JSON, true},
+		{"csv", "changelog.json", CSV, true},
+		{"xml", "", "", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseFormat(tt.name, tt.path)
+		if (err == nil) != tt.noError || got != tt.want {
+			t.Errorf("ParseFormat(%q, %q): got %q, %v; want %q", tt.name, tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidateEntries(t *testing.T) {
+	migrations := []mig.File{
+		{Ver: 5, FileName: "0005_Baseline.sql", Header: mig.Header{ReplacesFrom: 1, ReplacesTo: 5}},
+		{Ver: 6, FileName: "0006_Add_email.sql"},
+	}
+
+	var tests = []struct {
+		name    string
+		entries []Entry
+		errors  int
+	}{
+		{"valid", []Entry{{Version: 5, FileName: "0005_Baseline.sql"}, {Version: 6, FileName: "0006_Add_email.sql"}}, 0},
+		{"replaced by baseline", []Entry{{Version: 2, FileName: "0002_Archived.sql"}}, 0},
+		{"last replaced by baseline", []Entry{{Version: 5, FileName: "0005_Archived.sql"}}, 0},
+		{"renamed file", []Entry{{Version: 6, FileName: "0006_Add_mail.sql"}}, 1},
+		{"missing file", []Entry{{Version: 7, FileName: "0007_Add_index.sql"}}, 1},
+		{"repeated version", []Entry{{Version: 6, FileName: "0006_Add_email.sql"}, {Version: 6, FileName: "0006_Add_email.sql"}}, 1},
+	}
+	for _, tt := range tests {
+		if errs := ValidateEntries(tt.entries, migrations); len(errs) != tt.errors {
+			t.Errorf("%s: got errors %v, want %d errors", tt.name, errs, tt.errors)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+// Tool is another migration tool, whose history can be imported into the changelog
+type Tool string
+
+const (
+	Flyway        Tool = "flyway"
+	Goose         Tool = "goose"
+	GolangMigrate Tool = "golang-migrate"
+	Sqitch        Tool = "sqitch"
+)
+
+// Tools lists the tools, whose history can be imported
+var Tools = []Tool{Flyway, Goose, GolangMigrate, Sqitch}
+
+// HistoryTable returns the default name of the table, in which the tool records applied migrations
+func (t Tool) HistoryTable() string {
+	switch t {
+	case Flyway:
+		return "flyway_schema_history"
+	case Goose:
+		return "goose_db_version"
+	case GolangMigrate:
+		return "schema_migrations"
+	case Sqitch:
+		return "sqitch.changes"
+	}
+	return ""
+}
+
+// ParseTool checks that the name is one of the supported tools
+func ParseTool(name string) (Tool, error) {
+	for _, t := range Tools {
+		if string(t) == name {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown migration tool %q, expected flyway, goose, golang-migrate or sqitch", name)
+}
+
+// HistoryRecord is a migration recorded in the history table of another tool
+type HistoryRecord struct {
+	// Version is the version of the migration, or the name of the change for sqitch
+	Version string
+	// Script is the file name of the migration, if recorded (Flyway)
+	Script    string
+	AppliedBy string
+	AppliedAt time.Time
+	Success   bool
+	// Cumulative is set for records, which mark all earlier versions as applied too: the current
+	// version of golang-migrate and baselines of Flyway
+	Cumulative bool
+}
+
+// String returns the version and the script of the record, eg. "1.1 (V1_1__Add_index.sql)"
+func (r HistoryRecord) String() string {
+	if r.Version == "" {
+		return r.Script
+	}
+	if r.Script != "" {
+		return fmt.Sprintf("%s (%s)", r.Version, r.Script)
+	}
+	return r.Version
+}
+
+// History reads the migrations applied by the tool from its history table in the database of the session.
+// If table is empty, the default table of the tool is used.
+func (s *Session) History(tool Tool, table string) ([]HistoryRecord, error) {
+	if table == "" {
+		table = tool.HistoryTable()
+	}
+	var query string
+	switch tool {
+	case Flyway:
+		// Schema creation, undo and delete markers are not migrations. Baselines mark earlier versions as applied.
+		query = `SELECT COALESCE(version, ''), COALESCE(script, ''), COALESCE(installed_by, ''), installed_on, success,
+			type LIKE '%%BASELINE'
+			FROM %s WHERE type NOT IN ('SCHEMA', 'DELETE') AND type NOT LIKE 'UNDO%%' ORDER BY installed_rank`
+	case Goose:
+		// Goose adds a row for each apply and rollback, so only the last row of each version counts
+		query = `SELECT version_id::text, '', '', tstamp, true, false FROM (
+				SELECT DISTINCT ON (version_id) version_id, is_applied, tstamp FROM %s
+				WHERE version_id > 0 ORDER BY version_id, id DESC
+			) v WHERE is_applied ORDER BY version_id`
+	case GolangMigrate:
+		// Only the current version is recorded, with a dirty flag if it failed
+		query = `SELECT version::text, '', '', now(), NOT dirty, true FROM %s`
+	case Sqitch:
+		query = `SELECT change, '', COALESCE(committer_name, ''), committed_at, true, false FROM %s ORDER BY committed_at`
+	default:
+		return nil, fmt.Errorf("unknown migration tool %q", tool)
+	}
+	query = fmt.Sprintf(query, quoteQualifiedName(table))
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s history from table %s: %v", tool, table, err)
+	}
+	defer rows.Close()
+
+	var records []HistoryRecord
+	for rows.Next() {
+		var r HistoryRecord
+		err = rows.Scan(&r.Version, &r.Script, &r.AppliedBy, &r.AppliedAt, &r.Success, &r.Cumulative)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s history from table %s: %v", tool, table, err)
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s history from table %s: %v", tool, table, err)
+	}
+	return records, nil
+}
+
+// MapHistory maps the history records of another tool to the migration files and returns changelog
+// entries for them, sorted by version. A record is mapped to the file with the same file name (Flyway),
+// the same integer version, or the same title (sqitch changes, eg. "add_users" to "0003_Add_users.sql").
+// Records that cannot be mapped, like Flyway repeatable migrations or versions like "1.1" without a
+// file of the same name, are returned as unmapped.
+func MapHistory(tool Tool, records []HistoryRecord, migrations []mig.File) ([]Entry, []HistoryRecord) {
+	byName := map[string]mig.File{}
+	byVer := map[int]mig.File{}
+	byTitle := map[string]mig.File{}
+	for _, m := range migrations {
+		byName[m.FileName] = m
+		byVer[m.Ver] = m
+		byTitle[normalizeTitle(m.Title)] = m
+	}
+
+	mapped := map[int]Entry{}
+	var unmapped []HistoryRecord
+	for _, r := range records {
+		m, ok := byName[path.Base(r.Script)]
+		if !ok && r.Version != "" {
+			if ver, err := strconv.Atoi(r.Version); err == nil {
+				m, ok = byVer[ver]
+			}
+		}
+		if !ok && tool == Sqitch {
+			m, ok = byTitle[normalizeTitle(r.Version)]
+		}
+		if !ok {
+			unmapped = append(unmapped, r)
+			continue
+		}
+
+		if r.Cumulative {
+			for _, earlier := range migrations {
+				if _, done := mapped[earlier.Ver]; !done && earlier.Ver < m.Ver {
+					e := historyEntry(tool, earlier, r)
+					e.State, e.Status, e.LastError = true, string(StateApplied), ""
+					mapped[earlier.Ver] = e
+				}
+			}
+		}
+		mapped[m.Ver] = historyEntry(tool, m, r)
+	}
+
+	var entries []Entry
+	for _, m := range migrations {
+		if e, ok := mapped[m.Ver]; ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, unmapped
+}
+
+// historyEntry returns the changelog entry for the migration file, mapped from the history record
+func historyEntry(tool Tool, m mig.File, r HistoryRecord) Entry {
+	e := Entry{
+		Version:   m.Ver,
+		FileName:  m.FileName,
+		AppliedBy: r.AppliedBy,
+		DateTime:  r.AppliedAt,
+		State:     r.Success,
+		Attempts:  1,
+	}
+	if e.DateTime.IsZero() {
+		e.DateTime = time.Now().UTC()
+	}
+	if r.Success {
+		e.Status = string(StateApplied)
+	} else {
+		e.LastError = fmt.Sprintf("migration %s failed in %s", r, tool)
+	}
+	return e
+}
+
+// normalizeTitle returns the title in lower case with words separated by underscores,
+// so that "Add users", "add_users" and "add-users" are equal
+func normalizeTitle(title string) string {
+	title = strings.ToLower(strings.TrimSpace(title))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(title)
+}
+
+// quoteQualifiedName quotes the parts of a table name, which may be qualified with a schema name (eg. sqitch.changes)
+func quoteQualifiedName(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = `"` + sanitizeIdentifier(strings.Trim(p, `"`)) + `"`
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+func TestMapHistory(t *testing.T) {
+	migrations := []mig.File{
+		{Ver: 1, FileName: "0001_Create_users.sql", Title: "Create users"},
+		{Ver: 2, FileName: "0002_Add_email.sql", Title: "Add email"},
+		{Ver: 3, FileName: "0003_Add_index.sql", Title: "Add index"},
+	}
+	at := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name     string
+		tool     Tool
+		records  []HistoryRecord
+		applied  []int
+		failed   []int
+		unmapped []string
+	}{
+		{"flyway by version", Flyway, []HistoryRecord{
+			{Version: "1", Script: "V1__Create_users.sql", Success: true},
+			{Version: "2", Script: "V2__Add_email.sql", Success: false},
+			{Version: "", Script: "R__Views.sql", Success: true},
+			{Version: "2.1", Script: "V2_1__Fix.sql", Success: true},
+		}, []int{1}, []int{2}, []string{"R__Views.sql", "2.1 (V2_1__Fix.sql)"}},
+		{"flyway by script name", Flyway, []HistoryRecord{
+			{Version: "3.5", Script: "sql/0003_Add_index.sql", Success: true},
+		}, []int{3}, nil, nil},
+		{"flyway baseline", Flyway, []HistoryRecord{
+			{Version: "2", Script: "<< Flyway Baseline >>", Success: true, Cumulative: true},
+			{Version: "3", Script: "V3__Add_index.sql", Success: true},
+		}, []int{1, 2, 3}, nil, nil},
+		{"goose", Goose, []HistoryRecord{
+			{Version: "1", Success: true}, {Version: "3", Success: true}, {Version: "20200501120000", Success: true},
+		}, []int{1, 3}, nil, []string{"20200501120000"}},
+		{"golang-migrate dirty", GolangMigrate, []HistoryRecord{
+			{Version: "3", Success: false, Cumulative: true},
+		}, []int{1, 2}, []int{3}, nil},
+		{"sqitch", Sqitch, []HistoryRecord{
+			{Version: "create_users", Success: true}, {Version: "add-email", Success: true}, {Version: "add_roles", Success: true},
+		}, []int{1, 2}, nil, []string{"add_roles"}},
+	}
+
+	for _, tt := range tests {
+		for i := range tt.records {
+			tt.records[i].AppliedAt = at
+			tt.records[i].AppliedBy = "deploy"
+		}
+		entries, unmapped := MapHistory(tt.tool, tt.records, migrations)
+
+		var applied, failed []int
+		for _, e := range entries {
+			if e.State {
+				applied = append(applied, e.Version)
+			} else {
+				failed = append(failed, e.Version)
+			}
+			if !e.DateTime.Equal(at) || e.AppliedBy != "deploy" {
+				t.Errorf("%s: entry %+v should keep the original timestamp and user", tt.name, e)
+			}
+		}
+		var names []string
+		for _, r := range unmapped {
+			names = append(names, r.String())
+		}
+		if !reflect.DeepEqual(applied, tt.applied) || !reflect.DeepEqual(failed, tt.failed) || !reflect.DeepEqual(names, tt.unmapped) {
+			t.Errorf("%s: got applied %v, failed %v, unmapped %v; want %v, %v, %v", tt.name, applied, failed, names, tt.applied, tt.failed, tt.unmapped)
+		}
+	}
+}
+
+func TestQuoteQualifiedName(t *testing.T) {
+	var tests = []struct {
+		name string
+		want string
+	}{
+		{"flyway_schema_history", `"flyway_schema_history"`},
+		{"sqitch.changes", `"sqitch"."changes"`},
+		{`"app".schema_migrations`, `"app"."schema_migrations"`},
+	}
+	for _, tt := range tests {
+		if got := quoteQualifiedName(tt.name); got != tt.want {
+			t.Errorf("quoteQualifiedName(%s): got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+// Rehearsal is the result of running a single migration during a rehearsal
+type Rehearsal struct {
+	File mig.File
+	// Skipped is set for migrations that cannot run in a transaction and cannot be rehearsed
+	Skipped  bool
+	Duration time.Duration
+	// Locks lists the locks taken by the migration, eg. "person: AccessExclusiveLock"
+	Locks []string
+	Err   error
+}
+
+// Rehearse executes the migrations in a single transaction, which is always rolled back, and reports
+// whether each of them succeeded, how long it took and which locks it took. Migrations that cannot run
+// in a transaction are skipped, and only the first batch of batched migrations is run. Rehearsal stops at the first failed migration, as following ones usually
+// depend on it. The changelog is not modified.
+func (s *Session) Rehearse(migrations []mig.File) ([]Rehearsal, error) {
+	return s.RehearseContext(context.Background(), migrations)
+}
+
+// RehearseContext is like Rehearse, but cancels the running statement on the server, if the context is cancelled
+func (s *Session) RehearseContext(ctx context.Context, migrations []mig.File) ([]Rehearsal, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not open transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var results []Rehearsal
+	for _, m := range migrations {
+		r := Rehearsal{File: m}
+		if m.Header.NoTransaction {
+			r.Skipped = true
+			results = append(results, r)
+			continue
+		}
+
+		bytes, err := ioutil.ReadFile(m.Path)
+		if err != nil {
+			return results, fmt.Errorf("could not read migration file %s: %v", m.FileName, err)
+		}
+
+		locks, err := heldLocks(tx)
+		if err != nil {
+			return results, err
+		}
+		held := map[string]bool{}
+		for _, l := range locks {
+			held[l] = true
+		}
+
+		err = s.setSettings(ctx, tx, m, true)
+		if err != nil {
+			return results, err
+		}
+
+		sql := string(bytes)
+		// Only the first batch of a batched migration is rehearsed
+		if m.Header.BatchSize > 0 {
+			sql = batchSQL(sql, m.Header.BatchSize)
+		}
+
+		start := time.Now()
+		_, r.Err = tx.ExecContext(ctx, sql)
+		r.Duration = time.Since(start)
+		if r.Err != nil {
+			results = append(results, r)
+			break
+		}
+
+		locks, err = heldLocks(tx)
+		if err != nil {
+			return results, err
+		}
+		for _, l := range locks {
+			if !held[l] {
+				r.Locks = append(r.Locks, l)
+			}
+		}
+		results = append(results, r)
+	}
+
+	return results, nil
+}
+
+// heldLocksQuery lists the locks on relations held by the current session, except for the lock on pg_locks itself
+const heldLocksQuery = `
+	SELECT COALESCE(l.relation::regclass::text, l.relation::text) || ': ' || l.mode
+	FROM pg_locks l
+	WHERE l.pid = pg_backend_pid() AND l.granted AND l.locktype = 'relation' AND l.relation <> 'pg_locks'::regclass
+	ORDER BY 1`
+
+// heldLocks returns the locks on relations held by the transaction, sorted by relation and mode
+func heldLocks(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query(heldLocksQuery)
+	if err != nil {
+		return nil, fmt.Errorf("could not list locks: %v", err)
+	}
+	defer rows.Close()
+
+	var locks []string
+	for rows.Next() {
+		var l string
+		if err := rows.Scan(&l); err != nil {
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+	return locks, rows.Err()
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// schemaSection describes a group of objects in a schema dump. The query returns a sort key and
+// the DDL for each object. The {{filter}} placeholder is replaced with a condition excluding system
+// schemas (for a namespace aliased n) and {{changelog}} with the quoted name of the changelog table.
+type schemaSection struct {
+	title string
+	query string
+}
+
+const userNamespace = `n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg\_toast%' AND n.nspname NOT LIKE 'pg\_temp\_%'`
+
+// notExtensionMember returns a condition excluding objects created by extensions,
+// for an object from the given system catalog with the given alias
+func notExtensionMember(catalog string, alias string) string {
+	return fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM pg_depend dep WHERE dep.classid = '%s'::regclass AND dep.objid = %s.oid AND dep.deptype = 'e')`, catalog, alias)
+}
+
+var schemaSections = []schemaSection{
+	{"Extensions", `
+		SELECT o.extname, format('CREATE EXTENSION IF NOT EXISTS %I WITH SCHEMA %I;', o.extname, n.nspname)
+		FROM pg_extension o JOIN pg_namespace n ON n.oid = o.extnamespace
+		WHERE o.extname <> 'plpgsql'`},
+	{"Schemas", `
+		SELECT n.nspname, format('CREATE SCHEMA IF NOT EXISTS %I;', n.nspname)
+		FROM pg_namespace n
+		WHERE {{filter}} AND n.nspname <> 'public'`},
+	{"Types", `
+		SELECT format('%I.%I', n.nspname, o.typname),
+			CASE o.typtype
+			WHEN 'e' THEN format('CREATE TYPE %I.%I AS ENUM (%s);', n.nspname, o.typname,
+				(SELECT string_agg(quote_literal(e.enumlabel), ', ' ORDER BY e.enumsortorder) FROM pg_enum e WHERE e.enumtypid = o.oid))
+			WHEN 'd' THEN format('CREATE DOMAIN %I.%I AS %s%s%s%s;', n.nspname, o.typname, format_type(o.typbasetype, o.typtypmod),
+				CASE WHEN o.typnotnull THEN ' NOT NULL' ELSE '' END,
+				COALESCE(' DEFAULT ' || o.typdefault, ''),
+				COALESCE((SELECT string_agg(' CONSTRAINT ' || quote_ident(c.conname) || ' ' || pg_get_constraintdef(c.oid), '' ORDER BY c.conname)
+					FROM pg_constraint c WHERE c.contypid = o.oid), ''))
+			ELSE format('CREATE TYPE %I.%I AS (%s);', n.nspname, o.typname,
+				(SELECT string_agg(format('%I %s', a.attname, format_type(a.atttypid, a.atttypmod)), ', ' ORDER BY a.attnum)
+					FROM pg_attribute a WHERE a.attrelid = o.typrelid AND a.attnum > 0 AND NOT a.attisdropped))
+			END
+		FROM pg_type o JOIN pg_namespace n ON n.oid = o.typnamespace
+		WHERE {{filter}} AND ` + notExtensionMember("pg_type", "o") + `
+			AND (o.typtype IN ('e', 'd') OR (o.typtype = 'c' AND (SELECT relkind FROM pg_class WHERE oid = o.typrelid) = 'c'))`},
+	{"Sequences", `
+		SELECT format('%I.%I', n.nspname, o.relname),
+			format('CREATE SEQUENCE %I.%I AS %s INCREMENT BY %s MINVALUE %s MAXVALUE %s START WITH %s CACHE %s%s;',
+				n.nspname, o.relname, format_type(s.seqtypid, NULL), s.seqincrement, s.seqmin, s.seqmax, s.seqstart, s.seqcache,
+				CASE WHEN s.seqcycle THEN ' CYCLE' ELSE '' END)
+		FROM pg_class o JOIN pg_namespace n ON n.oid = o.relnamespace JOIN pg_sequence s ON s.seqrelid = o.oid
+		WHERE {{filter}} AND ` + notExtensionMember("pg_class", "o") + `
+			AND NOT EXISTS (SELECT 1 FROM pg_depend d JOIN pg_class t ON t.oid = d.refobjid
+				WHERE d.objid = o.oid AND d.deptype = 'a' AND t.relname = {{changelog}})`},
+	{"Tables", `
+		SELECT format('%I.%I', n.nspname, o.relname),
+			format(E'CREATE %sTABLE %I.%I (%s\n)%s;',
+				CASE WHEN o.relpersistence = 'u' THEN 'UNLOGGED ' ELSE '' END, n.nspname, o.relname,
+				COALESCE((SELECT string_agg(format(E'\n    %I %s%s%s', a.attname, format_type(a.atttypid, a.atttypmod),
+						CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END,
+						COALESCE(' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid), '')), ',' ORDER BY a.attnum)
+					FROM pg_attribute a LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+					WHERE a.attrelid = o.oid AND a.attnum > 0 AND NOT a.attisdropped), ''),
+				CASE WHEN o.relkind = 'p' THEN ' PARTITION BY ' || pg_get_partkeydef(o.oid) ELSE '' END)
+		FROM pg_class o JOIN pg_namespace n ON n.oid = o.relnamespace
+		WHERE {{filter}} AND ` + notExtensionMember("pg_class", "o") + `
+			AND o.relkind IN ('r', 'p') AND o.relname <> {{changelog}}`},
+	{"Constraints", `
+		SELECT format('%I.%I.%I', n.nspname, t.relname, o.conname),
+			format('ALTER TABLE %I.%I ADD CONSTRAINT %I %s;', n.nspname, t.relname, o.conname, pg_get_constraintdef(o.oid))
+		FROM pg_constraint o JOIN pg_class t ON t.oid = o.conrelid JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE {{filter}} AND ` + notExtensionMember("pg_class", "t") + `
+			AND t.relname <> {{changelog}} AND o.contype <> 'n'`},
+	{"Indexes", `
+		SELECT format('%I.%I', n.nspname, o.relname), pg_get_indexdef(o.oid) || ';'
+		FROM pg_index i JOIN pg_class o ON o.oid = i.indexrelid JOIN pg_class t ON t.oid = i.indrelid
+			JOIN pg_namespace n ON n.oid = o.relnamespace
+		WHERE {{filter}} AND t.relname <> {{changelog}}
+			AND NOT EXISTS (SELECT 1 FROM pg_constraint c WHERE c.conindid = o.oid AND c.contype IN ('p', 'u', 'x'))
+			AND ` + notExtensionMember("pg_class", "t")},
+	{"Views", `
+		SELECT format('%I.%I', n.nspname, o.relname),
+			format(E'CREATE %sVIEW %I.%I AS\n%s', CASE WHEN o.relkind = 'm' THEN 'MATERIALIZED ' ELSE '' END,
+				n.nspname, o.relname, rtrim(pg_get_viewdef(o.oid, true)))
+		FROM pg_class o JOIN pg_namespace n ON n.oid = o.relnamespace
+		WHERE {{filter}} AND ` + notExtensionMember("pg_class", "o") + ` AND o.relkind IN ('v', 'm')`},
+	{"Functions", `
+		SELECT format('%I.%I(%s)', n.nspname, o.proname, pg_get_function_identity_arguments(o.oid)),
+			rtrim(pg_get_functiondef(o.oid), E'\n') || ';'
+		FROM pg_proc o JOIN pg_namespace n ON n.oid = o.pronamespace
+		WHERE {{filter}} AND ` + notExtensionMember("pg_proc", "o") + ` AND o.prokind IN ('f', 'p')`},
+	{"Triggers", `
+		SELECT format('%I.%I.%I', n.nspname, t.relname, o.tgname), pg_get_triggerdef(o.oid) || ';'
+		FROM pg_trigger o JOIN pg_class t ON t.oid = o.tgrelid JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE {{filter}} AND NOT o.tgisinternal`},
+}
+
+// schemaObject is a single object in a schema dump
+type schemaObject struct {
+	key string
+	ddl string
+}
+
+// DumpSchema writes a description of the database schema as DDL statements, built by querying the
+// system catalogs. Objects are grouped by type and sorted by name, so dumps can be compared with diff.
+// The changelog table and objects created by extensions are not included.
+func (s *Session) DumpSchema(w io.Writer) error {
+	for _, section := range schemaSections {
+		query := strings.Replace(section.query, "{{filter}}", userNamespace, -1)
+		query = strings.Replace(query, "{{changelog}}", quoteString(sanitizeIdentifier(s.ChangelogName)), -1)
+
+		objects, err := s.schemaObjects(query)
+		if err != nil {
+			return fmt.Errorf("could not dump %s: %v", strings.ToLower(section.title), err)
+		}
+		if len(objects) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "--\n-- %s\n--\n\n", section.title)
+		for _, o := range objects {
+			fmt.Fprintf(w, "%s\n\n", o.ddl)
+		}
+	}
+	return nil
+}
+
+// schemaObjects executes the query for a section of the dump and returns the objects, sorted by key.
+// Sorting is done here rather than in SQL, so the order does not depend on the collation of the database.
+func (s *Session) schemaObjects(query string) ([]schemaObject, error) {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []schemaObject
+	for rows.Next() {
+		var o schemaObject
+		if err := rows.Scan(&o.key, &o.ddl); err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].key < objects[j].key
+	})
+	return objects, nil
+}
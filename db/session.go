@@ -1,67 +1,150 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"github.com/quasoft/pgmig/mig"
-
-	// Import postgres DB driver
-	_ "github.com/lib/pq"
 )
 
 // Session represents a user session to a specific PostgreSQL database
 type Session struct {
-	Host          string
-	Port          string
-	Database      string
-	Username      string
-	SslMode       string
+	Host     string
+	Port     string
+	Database string
+	Username string
+	// Password is used instead of PGPASSWORD or asking for it interactively, if set
+	Password string
+	SslMode  string
+	// Schema, if set, is put first in the search_path of the session, so that the changelog table
+	// and objects created by migrations without a schema name are stored in it
+	Schema        string
 	ChangelogName string
 	Interactive   bool
-	db            *sql.DB
+	// Driver is the name of the driver to connect with (see LookupDriver), pgx if empty
+	Driver string
+	// LockTimeout and StatementTimeout are values for the lock_timeout and statement_timeout
+	// settings (eg. "5s"), applied to each migration, unless overridden in its header
+	LockTimeout      string
+	StatementTimeout string
+	// Role, if set, is the role migrations are applied as (eg. the owner of the application objects),
+	// unless overridden in their header
+	Role string
+	// Settings are run-time parameters (eg. work_mem) set for each migration, unless overridden in its header
+	Settings map[string]string
+	// Retries is the number of times a transactional migration is retried after a lock timeout
+	Retries int
+	// RetryDelay is the delay before the first retry, doubled on each subsequent retry
+	RetryDelay time.Duration
+	// ConnectTimeout limits the duration of each connection attempt, if not zero
+	ConnectTimeout time.Duration
+	// Wait is the maximum time to keep retrying to connect, while the database is not available
+	// (eg. connection refused or starting up). Connect fails on the first error if zero.
+	Wait time.Duration
+	// OnConnectRetry, if set, is called before waiting to retry a failed connection attempt
+	OnConnectRetry func(attempt int, delay time.Duration, err error)
+	// OnBatch, if set, is called after each batch of a batched migration (see mig.Header.BatchSize)
+	OnBatch func(BatchProgress)
+	// Store, if set, keeps the changelog instead of the ChangelogName table in the database, eg. a MemoryStore
+	Store Store
+	// OnNotice, if set, is called for each notice sent by the server, eg. by RAISE NOTICE in a migration
+	OnNotice func(severity, message string)
+	db       *sql.DB
+	// sharedDB is true if db was passed in by the caller (see NewSessionFromDB) and should not be closed
+	sharedDB bool
 }
 
 // NewSession creates a new database session object
 func NewSession() *Session {
-	return &Session{}
+	return &Session{RetryDelay: time.Second}
+}
+
+// Clone creates a copy of the session settings, without the database connection
+func (s *Session) Clone() *Session {
+	clone := *s
+	clone.db = nil
+	clone.sharedDB = false
+	return &clone
+}
+
+// ResolvePassword reads the password from PGPASSWORD or asks for it interactively, unless already set
+func (s *Session) ResolvePassword() {
+	if s.Password == "" {
+		s.Password = getPassword(s.Interactive)
+	}
 }
 
 // Connect creates a new connection to the database and makes sure it is responding by pinging it.
 func (s *Session) Connect() error {
-	// Build connection string
-	password := getPassword(s.Interactive)
-	connStr := buildConnString(s.Host, s.Port, s.Database, s.Username, password, s.SslMode)
+	return s.ConnectContext(context.Background())
+}
 
-	// Open connection
-	db, err := sql.Open("postgres", connStr)
+// Disconnect closes the database connection
+func (s *Session) Disconnect() error {
+	if s.db == nil || s.sharedDB {
+		return nil
+	}
+	// Connect opens a new pool if db is nil
+	db := s.db
+	s.db = nil
+	return db.Close()
+}
+
+// QueryColumn executes the query and returns the values of the first column as strings
+func (s *Session) QueryColumn(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
-		return fmt.Errorf("could not open DB connection: %v", err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Test DB connection (ping)
-	var dummy string
-	err = db.QueryRow("SELECT 1;").Scan(&dummy)
-	if err != nil || dummy != "1" {
-		db.Close()
-		return fmt.Errorf("could not ping DB: %v", err)
+	var values []string
+	for rows.Next() {
+		var v sql.NullString
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v.String)
 	}
-	s.db = db
+	return values, rows.Err()
+}
 
-	return nil
+// Schemas returns the names of the schemas matching the LIKE pattern, sorted by name
+func (s *Session) Schemas(pattern string) ([]string, error) {
+	schemas, err := s.QueryColumn(`SELECT nspname FROM pg_namespace WHERE nspname LIKE $1 ORDER BY nspname`, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("could not list schemas matching %s: %v", pattern, err)
+	}
+	return schemas, nil
 }
 
-// Disconnect closes the database connection
-func (s *Session) Disconnect() error {
-	if s.db == nil {
-		return nil
+// ChangelogExists checks if the changelog table exists in the current schema.
+// Sessions with a custom Store always have a changelog.
+func (s *Session) ChangelogExists() (bool, error) {
+	if s.Store != nil {
+		return true, nil
 	}
-	return s.db.Close()
+	var exists bool
+	err := s.db.QueryRow(
+		`SELECT to_regclass(quote_ident(current_schema()) || '.' || quote_ident($1)) IS NOT NULL`,
+		sanitizeIdentifier(s.ChangelogName),
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("could not check if changelog table %s exists: %v", s.ChangelogName, err)
+	}
+	return exists, nil
 }
 
-// EnsureChangelogExists creates the changelog table if it does not exist
+// EnsureChangelogExists creates the changelog table if it does not exist.
+// Does nothing for sessions with a custom Store.
 func (s *Session) EnsureChangelogExists() error {
+	if s.Store != nil {
+		return nil
+	}
 	// TODO: Remove unused fields from table structure
 	sql := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" (
 		id serial,
@@ -78,111 +161,283 @@ func (s *Session) EnsureChangelogExists() error {
 		sanitizeIdentifier(s.ChangelogName),
 	)
 	_, err := s.db.Exec(sql)
-	return err
+	if err != nil {
+		return err
+	}
+	return s.UpgradeChangelog()
 }
 
-// insertLog records the migration in the changelog
-func (s *Session) insertLog(m mig.File) error {
-	sql := fmt.Sprintf(
-		`INSERT INTO %s (version, file_name) VALUES($1, $2)`,
+// UpgradeChangelog adds columns introduced in later versions of pgmig to an existing changelog table.
+// The table is only altered if some of the columns are missing, as altering it takes an exclusive lock
+// and requires owning the table.
+func (s *Session) UpgradeChangelog() error {
+	if s.Store != nil {
+		return nil
+	}
+	existing, err := s.QueryColumn(
+		`SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1`,
 		sanitizeIdentifier(s.ChangelogName),
 	)
-	_, err := s.db.Exec(sql, m.Ver, m.FileName)
-	return err
+	if err != nil {
+		return fmt.Errorf("could not read columns of changelog table %s: %v", s.ChangelogName, err)
+	}
+	found := map[string]bool{}
+	for _, c := range existing {
+		found[c] = true
+	}
+	columns := []string{
+		"attempts integer NOT NULL DEFAULT 0",
+		"last_error text",
+		// Status is "applied" or "skipped" for completed migrations, "interrupted" for migrations interrupted
+		// by cancellation, and NULL for failed migrations and rows created by older versions
+		"status varchar(20)",
+		// Progress of batched migrations
+		"batches integer NOT NULL DEFAULT 0",
+		"batch_rows bigint NOT NULL DEFAULT 0",
+		// Role and run-time parameters the migration was applied with
+		"applied_as varchar(100)",
+		"settings text",
+	}
+	for _, c := range columns {
+		if found[strings.Fields(c)[0]] {
+			continue
+		}
+		sql := fmt.Sprintf(
+			`ALTER TABLE "%s" ADD COLUMN IF NOT EXISTS %s`,
+			sanitizeIdentifier(s.ChangelogName),
+			c,
+		)
+		if _, err := s.db.Exec(sql); err != nil {
+			return fmt.Errorf("could not upgrade changelog table %s: %v", s.ChangelogName, err)
+		}
+	}
+	return nil
 }
 
-func (s *Session) updateLog(migVer int, state bool) error {
-	sql := fmt.Sprintf(
-		`UPDATE %s SET state = $1 WHERE version = $2`,
-		sanitizeIdentifier(s.ChangelogName),
-	)
-	_, err := s.db.Exec(sql, state, migVer)
-	return err
+// Skip records the migration in the changelog as skipped, so that it is no longer pending.
+// Used for migrations that belong to contexts (environments) other than the selected ones.
+func (s *Session) Skip(m mig.File) error {
+	err := s.store().Skip(m)
+	if err != nil {
+		return fmt.Errorf("could not record migration #%d as skipped in changelog: %v", m.Ver, err)
+	}
+	return nil
 }
 
-// lastMigratedVer returns the version of the last migration file that was applied successfully,
-// according to the changelog table
-func (s *Session) lastMigratedVer() (int, error) {
-	query := fmt.Sprintf(
-		`SELECT COALESCE(MAX(version), 0) FROM "%s" WHERE state = true`,
-		sanitizeIdentifier(s.ChangelogName),
-	)
-	var migVer int
-	err := s.db.QueryRow(query).Scan(&migVer)
-	if err == sql.ErrNoRows {
-		return 0, nil
+// Apply executes the migration file and records it in the changelog.
+// Unless the migration is marked with "-- pgmig:no-transaction", it is executed in a transaction
+// and retried with exponential backoff if it fails due to a lock timeout. Batched migrations are
+// executed in a transaction per batch and resume from the last completed batch when retried.
+func (s *Session) Apply(m mig.File) error {
+	return s.ApplyContext(context.Background(), m)
+}
+
+// ApplyContext is like Apply, but cancels the running statement on the server and rolls back
+// its transaction, if the context is cancelled. The migration is then marked as interrupted
+// in the changelog and the returned error wraps the error of the context.
+func (s *Session) ApplyContext(ctx context.Context, m mig.File) error {
+	bytes, err := ioutil.ReadFile(m.Path)
+	if err != nil {
+		return fmt.Errorf("could not read migration file %s: %v", m.FileName, err)
+	}
+	sql := string(bytes)
+
+	store := s.store()
+	hasFailed, err := store.Failed(m.Ver)
+	if err != nil {
+		return fmt.Errorf("could not check state of migration #%d for file %s: %v", m.Ver, m.FileName, err)
+	}
+	if !hasFailed {
+		err = store.Insert(m)
 	}
 	if err != nil {
-		return 0, fmt.Errorf("could not get version of last migration from changelog table: %v", err)
+		return fmt.Errorf("could not add migration #%d for file %s to changelog: %v", m.Ver, m.FileName, err)
+	}
+
+	retries := s.Retries
+	if m.Header.Retries != nil {
+		retries = *m.Header.Retries
+	}
+	delay := s.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err = store.Attempt(m.Ver)
+		if err != nil {
+			return fmt.Errorf("could not record attempt to apply migration #%d in changelog: %v", m.Ver, err)
+		}
+
+		if m.Header.BatchSize > 0 {
+			err = s.applyBatched(ctx, m, sql)
+		} else if m.Header.NoTransaction {
+			err = s.applyWithoutTx(ctx, m, sql)
+		} else {
+			err = s.applyInTx(ctx, m, sql)
+		}
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return s.interrupted(ctx, m, err)
+		}
+
+		store.Fail(m.Ver, err)
+		if m.Header.NoTransaction || !isLockTimeout(err) || attempt >= retries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return s.interrupted(ctx, m, err)
+		}
+		delay *= 2
 	}
+}
 
-	return migVer, nil
+// complete marks the migration as applied in the changelog, together with the role
+// and the settings it was applied with
+func (s *Session) complete(ctx context.Context, ex Execer, m mig.File) error {
+	return s.store().Complete(ctx, ex, m.Ver, s.role(m), formatSettings(s.settings(m)))
 }
 
-// failed checks if the specified migration is in failed state
-func (s *Session) failed(migVer int) (bool, error) {
-	sql := fmt.Sprintf(
-		`SELECT COUNT(*) FROM "%s" WHERE state = false AND version = $1`,
-		sanitizeIdentifier(s.ChangelogName),
-	)
-	var cnt int
-	err := s.db.QueryRow(sql, migVer).Scan(&cnt)
+// interrupted marks the migration as interrupted in the changelog and returns an error wrapping
+// the error of the cancelled context
+func (s *Session) interrupted(ctx context.Context, m mig.File, migErr error) error {
+	logErr := s.store().Interrupt(m.Ver, migErr)
+	if logErr != nil {
+		return fmt.Errorf("migration #%d from file %s was interrupted (%w) and could not be marked as interrupted in changelog: %v", m.Ver, m.FileName, ctx.Err(), logErr)
+	}
+	return fmt.Errorf("migration #%d from file %s was interrupted: %w", m.Ver, m.FileName, ctx.Err())
+}
+
+// applyInTx executes the migration and marks it as completed in a single transaction
+func (s *Session) applyInTx(ctx context.Context, m mig.File, sql string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not open transaction: %v", err)
+	}
+
+	err = s.setSettings(ctx, tx, m, true)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, sql)
 	if err != nil {
-		return false, fmt.Errorf("could not check in changelog %s if migration #%d failed: %v", s.ChangelogName, migVer, err)
+		tx.Rollback()
+		return fmt.Errorf("could not execute migration #%d from file %s: %w", m.Ver, m.FileName, err)
 	}
 
-	return cnt > 0, nil
+	err = s.resetRole(ctx, tx, m)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = s.complete(ctx, tx, m)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not mark migration #%d for file %s as completed in DB, rolling back...: %v", m.Ver, m.FileName, err)
+	}
+
+	return tx.Commit()
 }
 
-// wasApplied checks if the specified migration was applied to DB
-func (s *Session) wasApplied(migVer int) (bool, error) {
-	sql := fmt.Sprintf(
-		`SELECT COUNT(*) FROM "%s" WHERE state = true AND version = $1`,
-		sanitizeIdentifier(s.ChangelogName),
-	)
-	var cnt int
-	err := s.db.QueryRow(sql, migVer).Scan(&cnt)
+// applyWithoutTx executes a migration that cannot run in a transaction (eg. CREATE INDEX CONCURRENTLY)
+func (s *Session) applyWithoutTx(ctx context.Context, m mig.File, sql string) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get DB connection: %v", err)
+	}
+	defer conn.Close()
+
+	// Settings must not leak to other uses of the pooled connection, even if the context is cancelled
+	defer conn.ExecContext(context.Background(), `RESET ALL; RESET ROLE`)
+	err = s.setSettings(ctx, conn, m, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, sql)
 	if err != nil {
-		return false, fmt.Errorf("could not check in changelog %s if migration #%d was applied: %v", s.ChangelogName, migVer, err)
+		return fmt.Errorf("could not execute migration #%d from file %s: %w", m.Ver, m.FileName, err)
 	}
 
-	return cnt > 0, nil
+	err = s.resetRole(ctx, conn, m)
+	if err != nil {
+		return err
+	}
+	err = s.complete(ctx, conn, m)
+	if err != nil {
+		return fmt.Errorf("could not mark migration #%d for file %s as completed in DB: %v", m.Ver, m.FileName, err)
+	}
+	return nil
 }
 
-func (s *Session) Apply(m mig.File) error {
-	bytes, err := ioutil.ReadFile(m.Path)
+// Revert executes the down script of the migration and removes it from the changelog in a single transaction
+func (s *Session) Revert(m mig.File) error {
+	if m.DownPath == "" {
+		return fmt.Errorf("migration #%d from file %s has no down script", m.Ver, m.FileName)
+	}
+	bytes, err := ioutil.ReadFile(m.DownPath)
 	if err != nil {
-		return fmt.Errorf("could not read migration file %s: %v", m.FileName, err)
+		return fmt.Errorf("could not read down script %s: %v", m.DownPath, err)
 	}
 
-	sql := string(bytes)
 	tx, err := s.db.Begin()
 	if err != nil {
 		return fmt.Errorf("could not open transaction: %v", err)
 	}
 
-	hasFailed, err := s.failed(m.Ver)
+	_, err = tx.Exec(string(bytes))
 	if err != nil {
-		return fmt.Errorf("could not check state of migration #%d for file %s: %v", m.Ver, m.FileName, err)
-	}
-	if !hasFailed {
-		err = s.insertLog(m)
+		tx.Rollback()
+		return fmt.Errorf("could not revert migration #%d with down script %s: %v", m.Ver, m.DownPath, err)
 	}
+
+	err = s.store().Remove(context.Background(), tx, m.Ver)
 	if err != nil {
 		tx.Rollback()
-		return fmt.Errorf("could not add migration #%d for file %s to changelog, rolling back...: %v", m.Ver, m.FileName, err)
+		return fmt.Errorf("could not remove migration #%d from changelog: %v", m.Ver, err)
 	}
 
-	_, err = s.db.Exec(sql)
+	return tx.Commit()
+}
+
+// RunHook executes the hook script at the given path in a transaction. Each variable is made available
+// to the script as a "pgmig.<name>" setting, which can be read with current_setting('pgmig.<name>').
+func (s *Session) RunHook(path string, vars map[string]string) error {
+	return s.RunHookContext(context.Background(), path, vars)
+}
+
+// RunHookContext is like RunHook, but cancels the hook and rolls back its transaction, if the context is cancelled
+func (s *Session) RunHookContext(ctx context.Context, path string, vars map[string]string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read hook file %s: %v", path, err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not open transaction: %v", err)
+	}
+
+	// Hooks run with the role and settings of the session
+	err = s.setSettings(ctx, tx, mig.File{}, true)
 	if err != nil {
 		tx.Rollback()
-		return fmt.Errorf("could not execute migration #%d from file %s: %v", m.Ver, m.FileName, err)
+		return err
+	}
+	for name, value := range vars {
+		_, err = tx.ExecContext(ctx, `SELECT set_config($1, $2, true)`, "pgmig."+name, value)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not set variable %s for hook %s: %v", name, path, err)
+		}
 	}
 
-	err = s.updateLog(m.Ver, true)
+	_, err = tx.ExecContext(ctx, string(bytes))
 	if err != nil {
 		tx.Rollback()
-		return fmt.Errorf("could not mark migration #%d for file %s as completed in DB, rolling back...: %v", m.Ver, m.FileName, err)
+		return fmt.Errorf("could not execute hook %s: %v", path, err)
 	}
 
 	return tx.Commit()
@@ -192,7 +447,8 @@ func (s *Session) Apply(m mig.File) error {
 func (s *Session) PendingMigrations(dir *mig.Dir) ([]mig.File, error) {
 	// TODO: Use version of last applied migration and only check later migrations
 	// Get version of last applied migration
-	lastVer, err := s.lastMigratedVer()
+	store := s.store()
+	lastVer, err := store.LastApplied()
 	if err != nil {
 		return nil, fmt.Errorf("could not determine version of last migration: %v", err)
 	}
@@ -207,8 +463,13 @@ func (s *Session) PendingMigrations(dir *mig.Dir) ([]mig.File, error) {
 		if m.Ver <= lastVer {
 			continue
 		}
+		// A baseline cannot be applied on top of some of the migrations it replaces
+		if m.Header.ReplacesTo > 0 && lastVer >= m.Header.ReplacesFrom {
+			return pending, fmt.Errorf("baseline %s replaces migrations #%d-#%d, but only migrations up to #%d have been applied; apply the archived migrations first",
+				m.RelPath, m.Header.ReplacesFrom, m.Header.ReplacesTo, lastVer)
+		}
 		// Make sure the specific migration was not applied
-		applied, err := s.wasApplied(m.Ver)
+		applied, err := store.Applied(m.Ver)
 		if err != nil {
 			return pending, err
 		}
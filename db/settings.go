@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+// setting is a run-time parameter set for a migration, eg. work_mem
+type setting struct {
+	name  string
+	value string
+}
+
+// role returns the role to apply the migration as, or an empty string for the login user
+func (s *Session) role(m mig.File) string {
+	if m.Header.Role != "" {
+		return m.Header.Role
+	}
+	return s.Role
+}
+
+// settings returns the parameters to set for the migration, in the order they are applied: the session
+// settings (sorted by name) overridden by the migration header, followed by lock_timeout and statement_timeout.
+func (s *Session) settings(m mig.File) []setting {
+	values := map[string]string{}
+	for name, value := range s.Settings {
+		values[name] = value
+	}
+	for name, value := range m.Header.Settings {
+		values[name] = value
+	}
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []setting
+	for _, name := range names {
+		result = append(result, setting{name, values[name]})
+	}
+
+	lockTimeout, statementTimeout := s.LockTimeout, s.StatementTimeout
+	if m.Header.LockTimeout != "" {
+		lockTimeout = m.Header.LockTimeout
+	}
+	if m.Header.StatementTimeout != "" {
+		statementTimeout = m.Header.StatementTimeout
+	}
+	if lockTimeout != "" {
+		result = append(result, setting{"lock_timeout", lockTimeout})
+	}
+	if statementTimeout != "" {
+		result = append(result, setting{"statement_timeout", statementTimeout})
+	}
+	return result
+}
+
+// formatSettings returns the settings as a comma separated list of name=value pairs, as recorded in the changelog
+func formatSettings(settings []setting) string {
+	var pairs []string
+	for _, st := range settings {
+		pairs = append(pairs, st.name+"="+st.value)
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// setSettings switches to the role and applies the run-time parameters for the migration.
+// If local is true, they only last until the end of the current transaction.
+func (s *Session) setSettings(ctx context.Context, ex Execer, m mig.File, local bool) error {
+	settings := s.settings(m)
+	if role := s.role(m); role != "" {
+		// Equivalent to SET [LOCAL] ROLE
+		settings = append([]setting{{"role", role}}, settings...)
+	}
+	for _, st := range settings {
+		_, err := ex.ExecContext(ctx, `SELECT set_config($1, $2, $3)`, st.name, st.value, local)
+		if err != nil {
+			return fmt.Errorf("could not set %s to %s: %v", st.name, st.value, err)
+		}
+	}
+	return nil
+}
+
+// resetRole switches back to the login user, so that the changelog can be updated, even if the role
+// of the migration has no privileges on it
+func (s *Session) resetRole(ctx context.Context, ex Execer, m mig.File) error {
+	if s.role(m) == "" {
+		return nil
+	}
+	_, err := ex.ExecContext(ctx, `RESET ROLE`)
+	if err != nil {
+		return fmt.Errorf("could not reset role: %v", err)
+	}
+	return nil
+}
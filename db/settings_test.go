@@ -0,0 +1,34 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+func TestSettings(t *testing.T) {
+	s := NewSession()
+	s.Role = "migrator"
+	s.Settings = map[string]string{"work_mem": "64MB", "search_path": "app"}
+	s.LockTimeout = "5s"
+
+	var tests = []struct {
+		header mig.Header
+		role   string
+		want   string
+	}{
+		{mig.Header{}, "migrator", "search_path=app, work_mem=64MB, lock_timeout=5s"},
+		{mig.Header{Role: "app_owner", Settings: map[string]string{"work_mem": "1GB"}, StatementTimeout: "10min"},
+			"app_owner", "search_path=app, work_mem=1GB, lock_timeout=5s, statement_timeout=10min"},
+	}
+
+	for _, tt := range tests {
+		m := mig.File{Header: tt.header}
+		if got := s.role(m); got != tt.role {
+			t.Errorf("role(%+v): got %q, want %q", tt.header, got, tt.role)
+		}
+		if got := formatSettings(s.settings(m)); got != tt.want {
+			t.Errorf("settings(%+v): got %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+// State describes how a migration relates to the changelog of a database
+type State string
+
+const (
+	// StateApplied is a migration that was applied successfully
+	StateApplied State = "applied"
+	// StateSkipped is a migration that was not applied, because it belongs to contexts (environments)
+	// other than the selected ones
+	StateSkipped State = "skipped"
+	// StatePending is a migration that has not been applied yet
+	StatePending State = "pending"
+	// StateFailed is a migration whose last attempt to apply failed
+	StateFailed State = "failed"
+	// StateInterrupted is a migration, which was interrupted by cancellation (eg. SIGINT) while being applied
+	StateInterrupted State = "interrupted"
+	// StateDrift is a migration whose history differs from the files on disk: an applied migration
+	// whose file is missing or was renamed, or a migration older than the last applied one, which was never applied
+	StateDrift State = "drift"
+	// StateAhead is a migration applied to the database, whose version is newer than all migration files
+	StateAhead State = "ahead"
+)
+
+// Status is the state of a single migration in a database
+type Status struct {
+	Ver int
+	// File is the relative path of the migration file, or the file name from the changelog,
+	// if the file is missing
+	File  string
+	State State
+	// Contexts lists the environments the migration is applied in
+	Contexts []string
+	// Reason explains failed and drifted states
+	Reason    string
+	AppliedAt time.Time
+}
+
+// CompareChangelog matches the changelog entries of a database with the migration files and returns
+// the status of each migration, sorted by version. Entries replaced by a baseline are considered
+// to belong to the baseline.
+func CompareChangelog(entries []Entry, migrations []mig.File) []Status {
+	byVer := map[int]Entry{}
+	lastApplied := 0
+	for _, e := range entries {
+		byVer[e.Version] = e
+		if e.State && e.Version > lastApplied {
+			lastApplied = e.Version
+		}
+	}
+
+	var statuses []Status
+	lastFile := 0
+	replaced := map[int]bool{}
+	for _, m := range migrations {
+		if m.Ver > lastFile {
+			lastFile = m.Ver
+		}
+		if m.Header.ReplacesTo > 0 {
+			for v := m.Header.ReplacesFrom; v <= m.Header.ReplacesTo; v++ {
+				replaced[v] = true
+			}
+		}
+
+		st := Status{Ver: m.Ver, File: m.RelPath, Contexts: m.Contexts}
+		e, ok := byVer[m.Ver]
+		switch {
+		case !ok && m.Ver < lastApplied:
+			st.State = StateDrift
+			st.Reason = fmt.Sprintf("not applied, but newer migration #%d is", lastApplied)
+		case !ok:
+			st.State = StatePending
+		case !e.State && e.Status == string(StateInterrupted):
+			st.State = StateInterrupted
+			st.Reason = e.LastError
+		case !e.State:
+			st.State = StateFailed
+			st.Reason = e.LastError
+		// A baseline has the version of the last migration it replaces, but a different name
+		case e.FileName != m.FileName && m.Header.ReplacesTo == 0:
+			st.State = StateDrift
+			st.Reason = fmt.Sprintf("applied from file %s", e.FileName)
+		case e.Status == string(StateSkipped):
+			st.State = StateSkipped
+		default:
+			st.State = StateApplied
+		}
+		if ok {
+			st.AppliedAt = e.DateTime
+		}
+		statuses = append(statuses, st)
+	}
+
+	files := map[int]bool{}
+	for _, m := range migrations {
+		files[m.Ver] = true
+	}
+	for _, e := range entries {
+		if files[e.Version] || replaced[e.Version] {
+			continue
+		}
+		st := Status{Ver: e.Version, File: e.FileName, AppliedAt: e.DateTime}
+		if e.Version > lastFile {
+			st.State = StateAhead
+			st.Reason = "no migration file with this version"
+		} else {
+			st.State = StateDrift
+			st.Reason = "migration file is missing"
+		}
+		statuses = append(statuses, st)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Ver < statuses[j].Ver
+	})
+	return statuses
+}
+
+// Status returns the status of each migration in the directory and of each changelog entry without
+// a matching file. All migrations are pending if the changelog table does not exist.
+func (s *Session) Status(dir *mig.Dir) ([]Status, error) {
+	migrations, err := dir.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := s.ChangelogExists()
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	if exists {
+		entries, err = s.Changelog()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return CompareChangelog(entries, migrations), nil
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+func TestCompareChangelog(t *testing.T) {
+	file := func(ver int, name string) mig.File {
+		return *mig.NewFile(name, ver)
+	}
+	baseline := file(3, "3_Baseline.sql")
+	baseline.Header.ReplacesFrom, baseline.Header.ReplacesTo = 1, 3
+
+	var tests = []struct {
+		name       string
+		entries    []Entry
+		migrations []mig.File
+		want       []State
+	}{
+		{
+			"fresh database",
+			nil,
+			[]mig.File{file(1, "1_a.sql"), file(2, "2_b.sql")},
+			[]State{StatePending, StatePending},
+		},
+		{
+			"up to date",
+			[]Entry{{Version: 1, FileName: "1_a.sql", State: true}, {Version: 2, FileName: "2_b.sql", State: true}},
+			[]mig.File{file(1, "1_a.sql"), file(2, "2_b.sql")},
+			[]State{StateApplied, StateApplied},
+		},
+		{
+			"failed",
+			[]Entry{{Version: 1, FileName: "1_a.sql", State: true}, {Version: 2, FileName: "2_b.sql", State: false}},
+			[]mig.File{file(1, "1_a.sql"), file(2, "2_b.sql"), file(3, "3_c.sql")},
+			[]State{StateApplied, StateFailed, StatePending},
+		},
+		{
+			"interrupted",
+			[]Entry{{Version: 1, FileName: "1_a.sql", State: true}, {Version: 2, FileName: "2_b.sql", State: false, Status: "interrupted"}},
+			[]mig.File{file(1, "1_a.sql"), file(2, "2_b.sql")},
+			[]State{StateApplied, StateInterrupted},
+		},
+		{
+			"out of order",
+			[]Entry{{Version: 1, FileName: "1_a.sql", State: true}, {Version: 3, FileName: "3_c.sql", State: true}},
+			[]mig.File{file(1, "1_a.sql"), file(2, "2_b.sql"), file(3, "3_c.sql")},
+			[]State{StateApplied, StateDrift, StateApplied},
+		},
+		{
+			"missing and renamed files",
+			[]Entry{{Version: 1, FileName: "1_a.sql", State: true}, {Version: 2, FileName: "2_b.sql", State: true}},
+			[]mig.File{file(1, "1_renamed.sql"), file(3, "3_c.sql")},
+			[]State{StateDrift, StateDrift, StatePending},
+		},
+		{
+			"skipped",
+			[]Entry{{Version: 1, FileName: "1_a.sql", State: true}, {Version: 2, FileName: "2_b.sql", State: true, Status: "skipped"}},
+			[]mig.File{file(1, "1_a.sql"), file(2, "2_b.sql")},
+			[]State{StateApplied, StateSkipped},
+		},
+		{
+			"database ahead",
+			[]Entry{{Version: 1, FileName: "1_a.sql", State: true}, {Version: 2, FileName: "2_b.sql", State: true}},
+			[]mig.File{file(1, "1_a.sql")},
+			[]State{StateApplied, StateAhead},
+		},
+		{
+			"squashed",
+			[]Entry{{Version: 1, FileName: "1_a.sql", State: true}, {Version: 2, FileName: "2_b.sql", State: true}, {Version: 3, FileName: "3_c.sql", State: true}},
+			[]mig.File{baseline, file(4, "4_d.sql")},
+			[]State{StateApplied, StatePending},
+		},
+	}
+
+	for _, tt := range tests {
+		got := CompareChangelog(tt.entries, tt.migrations)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d statuses %+v, want %d", tt.name, len(got), got, len(tt.want))
+			continue
+		}
+		for i := range got {
+			if got[i].State != tt.want[i] {
+				t.Errorf("%s: got state %s for #%d, want %s", tt.name, got[i].State, got[i].Ver, tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+// Execer is implemented by *sql.DB, *sql.Tx and *sql.Conn
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Store keeps the changelog of a database: the migrations that were applied, skipped or failed.
+// By default sessions use the changelog table in the migrated database (see Session.Store).
+//
+// Methods taking an Execer are called with the transaction or connection the migration is executed in.
+// Stores kept in the migrated database record the change in it, so that it is committed or rolled
+// back together with the migration. Other stores ignore it.
+type Store interface {
+	// Entries returns all entries, sorted by version
+	Entries() ([]Entry, error)
+	// LastApplied returns the highest version that was applied or skipped, or 0 if none
+	LastApplied() (int, error)
+	// Applied checks if the migration with the version was applied or skipped
+	Applied(ver int) (bool, error)
+	// Failed checks if the migration with the version was started, but not completed
+	Failed(ver int) (bool, error)
+	// Insert adds an entry for a migration that is about to be applied
+	Insert(m mig.File) error
+	// Attempt increments the number of attempts to apply the migration
+	Attempt(ver int) error
+	// Fail records the error of the last attempt to apply the migration
+	Fail(ver int, migErr error) error
+	// Interrupt records that applying the migration was interrupted by cancellation
+	Interrupt(ver int, migErr error) error
+	// Skip adds or updates the entry of the migration as skipped, so that it is no longer pending
+	Skip(m mig.File) error
+	// Complete marks the migration as applied as the given role (the current user, if empty) and settings
+	Complete(ctx context.Context, ex Execer, ver int, appliedAs string, settings string) error
+	// Progress returns the number of completed batches and rows of a batched migration
+	Progress(ctx context.Context, ver int) (int, int64, error)
+	// AddBatch records a completed batch of a batched migration, which affected the given number of rows
+	AddBatch(ctx context.Context, ex Execer, ver int, rows int64) error
+	// Remove deletes the entry of a reverted migration
+	Remove(ctx context.Context, ex Execer, ver int) error
+	// Put adds the entry or replaces the entry with the same version, eg. when importing history
+	Put(ctx context.Context, ex Execer, e Entry) error
+}
+
+// MemoryStore is a changelog store kept in memory, for tests and planning.
+// Changes are not rolled back when the transaction of a migration is.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[int]*Entry
+	// User is recorded as the user applying migrations
+	User string
+	// onChange, if set, is called after each change, with the lock held
+	onChange func() error
+}
+
+// NewMemoryStore creates a store holding the given entries
+func NewMemoryStore(entries ...Entry) *MemoryStore {
+	st := &MemoryStore{entries: map[int]*Entry{}}
+	for i := range entries {
+		e := entries[i]
+		st.entries[e.Version] = &e
+	}
+	return st
+}
+
+// Entries returns all entries, sorted by version
+func (st *MemoryStore) Entries() ([]Entry, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.sorted(), nil
+}
+
+func (st *MemoryStore) sorted() []Entry {
+	entries := []Entry{}
+	for _, e := range st.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Version < entries[j].Version })
+	return entries
+}
+
+// LastApplied returns the highest version that was applied or skipped, or 0 if none
+func (st *MemoryStore) LastApplied() (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	last := 0
+	for _, e := range st.entries {
+		if e.State && e.Version > last {
+			last = e.Version
+		}
+	}
+	return last, nil
+}
+
+// Applied checks if the migration with the version was applied or skipped
+func (st *MemoryStore) Applied(ver int) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	e, ok := st.entries[ver]
+	return ok && e.State, nil
+}
+
+// Failed checks if the migration with the version was started, but not completed
+func (st *MemoryStore) Failed(ver int) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	e, ok := st.entries[ver]
+	return ok && !e.State, nil
+}
+
+// Insert adds an entry for a migration that is about to be applied
+func (st *MemoryStore) Insert(m mig.File) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.entries[m.Ver]; ok {
+		return fmt.Errorf("migration #%d is already in the changelog", m.Ver)
+	}
+	st.entries[m.Ver] = &Entry{Version: m.Ver, FileName: m.FileName, AppliedBy: st.User, DateTime: time.Now().UTC()}
+	return st.changed()
+}
+
+// Attempt increments the number of attempts to apply the migration
+func (st *MemoryStore) Attempt(ver int) error {
+	return st.update(ver, func(e *Entry) {
+		e.Attempts++
+	})
+}
+
+// Fail records the error of the last attempt to apply the migration
+func (st *MemoryStore) Fail(ver int, migErr error) error {
+	return st.update(ver, func(e *Entry) {
+		e.LastError = migErr.Error()
+		e.Status = ""
+	})
+}
+
+// Interrupt records that applying the migration was interrupted by cancellation
+func (st *MemoryStore) Interrupt(ver int, migErr error) error {
+	return st.update(ver, func(e *Entry) {
+		e.LastError = migErr.Error()
+		e.Status = string(StateInterrupted)
+	})
+}
+
+// Skip adds or updates the entry of the migration as skipped, so that it is no longer pending
+func (st *MemoryStore) Skip(m mig.File) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	e, ok := st.entries[m.Ver]
+	if !ok {
+		e = &Entry{Version: m.Ver, AppliedBy: st.User, DateTime: time.Now().UTC()}
+		st.entries[m.Ver] = e
+	}
+	e.FileName = m.FileName
+	e.State = true
+	e.Status = string(StateSkipped)
+	e.LastError = ""
+	return st.changed()
+}
+
+// Complete marks the migration as applied
+func (st *MemoryStore) Complete(ctx context.Context, ex Execer, ver int, appliedAs string, settings string) error {
+	return st.update(ver, func(e *Entry) {
+		e.State = true
+		e.Status = string(StateApplied)
+		e.LastError = ""
+		e.AppliedAs = appliedAs
+		if e.AppliedAs == "" {
+			e.AppliedAs = st.User
+		}
+		e.Settings = settings
+	})
+}
+
+// Progress returns the number of completed batches and rows of a batched migration
+func (st *MemoryStore) Progress(ctx context.Context, ver int) (int, int64, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	e, ok := st.entries[ver]
+	if !ok {
+		return 0, 0, fmt.Errorf("migration #%d is not in the changelog", ver)
+	}
+	return e.Batches, e.BatchRows, nil
+}
+
+// AddBatch records a completed batch of a batched migration
+func (st *MemoryStore) AddBatch(ctx context.Context, ex Execer, ver int, rows int64) error {
+	return st.update(ver, func(e *Entry) {
+		e.Batches++
+		e.BatchRows += rows
+	})
+}
+
+// Remove deletes the entry of a reverted migration
+func (st *MemoryStore) Remove(ctx context.Context, ex Execer, ver int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.entries, ver)
+	return st.changed()
+}
+
+// Put adds the entry or replaces the entry with the same version
+func (st *MemoryStore) Put(ctx context.Context, ex Execer, e Entry) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.entries[e.Version] = &e
+	return st.changed()
+}
+
+// update changes the entry of the migration with the version, which must exist
+func (st *MemoryStore) update(ver int, change func(e *Entry)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	e, ok := st.entries[ver]
+	if !ok {
+		return fmt.Errorf("migration #%d is not in the changelog", ver)
+	}
+	change(e)
+	return st.changed()
+}
+
+func (st *MemoryStore) changed() error {
+	if st.onChange == nil {
+		return nil
+	}
+	return st.onChange()
+}
+
+// FileStore is a changelog store kept in a JSON file with an array of entries, eg. for planning
+// migrations offline against a copy of the changelog of a database. The file is rewritten after each change.
+type FileStore struct {
+	*MemoryStore
+	Path string
+}
+
+// NewFileStore reads the changelog from the JSON file at the given path.
+// A missing file is created on the first change.
+func NewFileStore(path string) (*FileStore, error) {
+	var entries []Entry
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read changelog file %s: %v", path, err)
+	}
+	if err == nil {
+		err = json.Unmarshal(bytes, &entries)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse changelog file %s: %v", path, err)
+		}
+	}
+
+	st := &FileStore{MemoryStore: NewMemoryStore(entries...), Path: path}
+	st.onChange = st.save
+	return st, nil
+}
+
+// save writes the entries to a temporary file, which then replaces the changelog file
+func (st *FileStore) save() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(st.Path), filepath.Base(st.Path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not write changelog file %s: %v", st.Path, err)
+	}
+	err = WriteEntries(tmp, st.sorted(), JSON)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), st.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not write changelog file %s: %v", st.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/quasoft/pgmig/mig"
+)
+
+// fakeDB is a database/sql driver recording executed statements, which fail if fail returns an error
+type fakeDB struct {
+	executed []string
+	fail     func(query string) error
+	// rows, if set, returns the values of the single column returned by queries, instead of "1"
+	rows func(query string) []string
+	// affected, if set, returns the number of rows affected by executed statements, instead of 0
+	affected func(query string) int64
+}
+
+func (f *fakeDB) Connect(ctx context.Context) (driver.Conn, error) { return &fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                            { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return c.record("COMMIT") }
+func (c *fakeConn) Rollback() error           { return c.record("ROLLBACK") }
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.record(query); err != nil {
+		return nil, err
+	}
+	if c.db.affected != nil {
+		return driver.RowsAffected(c.db.affected(query)), nil
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// QueryContext returns the rows of fakeDB.rows, or a single row with the value 1, eg. for pinging
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.record(query); err != nil {
+		return nil, err
+	}
+	values := []string{"1"}
+	if c.db.rows != nil {
+		values = c.db.rows(query)
+	}
+	return &fakeRows{values}, nil
+}
+
+type fakeRows struct{ values []string }
+
+func (r *fakeRows) Columns() []string { return []string{"?column?"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+func (c *fakeConn) record(query string) error {
+	if c.db.fail != nil {
+		if err := c.db.fail(query); err != nil {
+			return err
+		}
+	}
+	c.db.executed = append(c.db.executed, query)
+	return nil
+}
+
+// testDir creates a migrations directory with a file for each of the SQL statements, versioned from 1
+func testDir(t *testing.T, statements ...string) *mig.Dir {
+	path, err := ioutil.TempDir("", "pgmig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, stmt := range statements {
+		name := filepath.Join(path, string(rune('1'+i))+"_Migration.sql")
+		if err := ioutil.WriteFile(name, []byte(stmt), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := mig.NewDir()
+	d.Path = path
+	return d
+}
+
+func versions(migrations []mig.File) []int {
+	vers := []int{}
+	for _, m := range migrations {
+		vers = append(vers, m.Ver)
+	}
+	return vers
+}
+
+func TestPendingMigrations(t *testing.T) {
+	d := testDir(t, "SELECT 1", "SELECT 2", "SELECT 3", "SELECT 4")
+	defer os.RemoveAll(d.Path)
+
+	var tests = []struct {
+		name    string
+		entries []Entry
+		want    []int
+	}{
+		{"empty changelog", nil, []int{1, 2, 3, 4}},
+		{"applied", []Entry{{Version: 1, State: true}, {Version: 2, State: true}}, []int{3, 4}},
+		{"failed", []Entry{{Version: 1, State: true}, {Version: 2}}, []int{2, 3, 4}},
+		{"skipped", []Entry{{Version: 1, State: true, Status: "skipped"}}, []int{2, 3, 4}},
+		{"older than last applied", []Entry{{Version: 1, State: true}, {Version: 3, State: true}}, []int{4}},
+		{"all applied", []Entry{{Version: 4, State: true}}, []int{}},
+	}
+
+	for _, tt := range tests {
+		s := NewSession()
+		s.Store = NewMemoryStore(tt.entries...)
+		got, err := s.PendingMigrations(d)
+		if err != nil {
+			t.Fatalf("%s: PendingMigrations returned error %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(versions(got), tt.want) {
+			t.Errorf("%s: got pending %v, want %v", tt.name, versions(got), tt.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	d := testDir(t, "CREATE TABLE a ()", "CREATE TABLE b ()", "BROKEN", "CREATE TABLE d ()")
+	defer os.RemoveAll(d.Path)
+
+	f := &fakeDB{fail: func(query string) error {
+		if query == "BROKEN" {
+			return errors.New("syntax error")
+		}
+		return nil
+	}}
+	store := NewMemoryStore(Entry{Version: 1, State: true, Status: "applied"})
+	s := NewSessionFromDB(sql.OpenDB(f))
+	s.Store = store
+
+	// Pending migrations are applied in order until the first failure
+	pending, err := s.PendingMigrations(d)
+	if err != nil {
+		t.Fatalf("PendingMigrations returned error %v", err)
+	}
+	for _, m := range pending {
+		if err = s.Apply(m); err != nil {
+			break
+		}
+	}
+	if err == nil || !strings.Contains(err.Error(), "syntax error") {
+		t.Fatalf("Apply should have returned the error of migration #3, got %v", err)
+	}
+	want := []string{"CREATE TABLE b ()", "COMMIT", "ROLLBACK"}
+	if !reflect.DeepEqual(f.executed, want) {
+		t.Errorf("got executed statements %q, want %q", f.executed, want)
+	}
+
+	entries, _ := store.Entries()
+	if len(entries) != 3 || !entries[1].State || entries[1].Status != "applied" || entries[1].Attempts != 1 {
+		t.Fatalf("migration #2 should be applied, got entries %+v", entries)
+	}
+	if failed := entries[2]; failed.State || failed.Attempts != 1 || failed.LastError == "" {
+		t.Errorf("migration #3 should be failed with its error, got %+v", failed)
+	}
+	pending, _ = s.PendingMigrations(d)
+	if !reflect.DeepEqual(versions(pending), []int{3, 4}) {
+		t.Errorf("got pending %v after failure, want [3 4]", versions(pending))
+	}
+
+	// A failed migration is applied again without adding a second entry
+	f.fail = nil
+	if err = s.Apply(pending[0]); err != nil {
+		t.Fatalf("Apply returned error %v on second attempt", err)
+	}
+	entries, _ = store.Entries()
+	if e := entries[2]; !e.State || e.Attempts != 2 || e.LastError != "" {
+		t.Errorf("migration #3 should be applied after 2 attempts, got %+v", e)
+	}
+}
+
+func TestApplyRetries(t *testing.T) {
+	d := testDir(t, "ALTER TABLE a ADD b int")
+	defer os.RemoveAll(d.Path)
+	migrations, err := d.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		err      error
+		failures int
+		retries  int
+		attempts int
+		applied  bool
+	}{
+		{"lock timeout retried", &pgconn.PgError{Code: "55P03"}, 2, 2, 3, true},
+		{"lock timeout retries exhausted", &pgconn.PgError{Code: "55P03"}, 2, 1, 2, false},
+		{"other errors not retried", &pgconn.PgError{Code: "42P01"}, 1, 2, 1, false},
+	}
+
+	for _, tt := range tests {
+		failures := 0
+		f := &fakeDB{fail: func(query string) error {
+			if strings.HasPrefix(query, "ALTER") && failures < tt.failures {
+				failures++
+				return tt.err
+			}
+			return nil
+		}}
+		store := NewMemoryStore()
+		s := NewSessionFromDB(sql.OpenDB(f))
+		s.Store = store
+		s.Retries = tt.retries
+		s.RetryDelay = 0
+
+		err := s.Apply(migrations[0])
+		if (err == nil) != tt.applied {
+			t.Errorf("%s: Apply returned error %v", tt.name, err)
+		}
+		entries, _ := store.Entries()
+		if entries[0].Attempts != tt.attempts || entries[0].State != tt.applied {
+			t.Errorf("%s: got %+v, want %d attempts and state %v", tt.name, entries[0], tt.attempts, tt.applied)
+		}
+	}
+}
+
+func TestUpgradeChangelog(t *testing.T) {
+	var tests = []struct {
+		name    string
+		columns []string
+		want    []string
+	}{
+		{"current", []string{"version", "attempts", "last_error", "status", "batches", "batch_rows", "applied_as", "settings"}, nil},
+		{"older version", []string{"version", "attempts", "last_error", "status"}, []string{"batches", "batch_rows", "applied_as", "settings"}},
+	}
+	for _, tt := range tests {
+		f := &fakeDB{rows: func(query string) []string { return tt.columns }}
+		s := NewSessionFromDB(sql.OpenDB(f))
+		if err := s.UpgradeChangelog(); err != nil {
+			t.Fatalf("%s: UpgradeChangelog returned error %v", tt.name, err)
+		}
+		var added []string
+		for _, q := range f.executed {
+			if i := strings.Index(q, "ADD COLUMN IF NOT EXISTS "); i >= 0 {
+				added = append(added, strings.Fields(q[i+len("ADD COLUMN IF NOT EXISTS "):])[0])
+			}
+		}
+		if !reflect.DeepEqual(added, tt.want) {
+			t.Errorf("%s: got added columns %v, want %v", tt.name, added, tt.want)
+		}
+		// The table is not altered, and so not locked, if it is up to date
+		if tt.want == nil && len(f.executed) != 1 {
+			t.Errorf("%s: got executed statements %q, want only the query of the columns", tt.name, f.executed)
+		}
+	}
+}
+
+func TestImportEntries(t *testing.T) {
+	entries := []Entry{{Version: 1, FileName: "1_Migration.sql", State: true}, {Version: 2, FileName: "2_Migration.sql", State: true}}
+
+	// Other stores: existing entries are only replaced with ReplaceOnConflict
+	store := NewMemoryStore(Entry{Version: 1, FileName: "1_Migration.sql"})
+	s := NewSession()
+	s.Store = store
+	conflicts, err := s.ImportEntries(entries, FailOnConflict)
+	if err == nil || !reflect.DeepEqual(conflicts, []int{1}) {
+		t.Errorf("ImportEntries should fail with conflict #1, got %v, %v", conflicts, err)
+	}
+	if got, _ := store.Entries(); len(got) != 1 || got[0].State {
+		t.Errorf("ImportEntries should not change the store on conflict, got %+v", got)
+	}
+	if _, err = s.ImportEntries(entries, ReplaceOnConflict); err != nil {
+		t.Fatalf("ImportEntries with replace returned error %v", err)
+	}
+	if got, _ := store.Entries(); !reflect.DeepEqual(got, entries) {
+		t.Errorf("got entries %+v, want %+v", got, entries)
+	}
+
+	// Changelog table: the fake database returns version 1 as existing
+	var tests = []struct {
+		name       string
+		onConflict Conflict
+		fail       bool
+		want       []string
+	}{
+		{"conflict", FailOnConflict, false, []string{"LOCK", "SELECT", "ROLLBACK"}},
+		{"replace", ReplaceOnConflict, false, []string{"LOCK", "SELECT", "INSERT", "INSERT", "COMMIT"}},
+		{"skip", SkipOnConflict, false, []string{"LOCK", "SELECT", "INSERT", "COMMIT"}},
+		{"failed insert", ReplaceOnConflict, true, []string{"LOCK", "SELECT", "INSERT", "ROLLBACK"}},
+	}
+	for _, tt := range tests {
+		inserts := 0
+		f := &fakeDB{fail: func(query string) error {
+			if strings.HasPrefix(query, "INSERT") {
+				inserts++
+				if tt.fail && inserts == 2 {
+					return errors.New("check constraint violated")
+				}
+			}
+			return nil
+		}}
+		s := NewSessionFromDB(sql.OpenDB(f))
+		conflicts, err := s.ImportEntries(entries, tt.onConflict)
+		if (err != nil) != (tt.fail || tt.onConflict == FailOnConflict) || !reflect.DeepEqual(conflicts, []int{1}) {
+			t.Errorf("%s: got conflicts %v, error %v", tt.name, conflicts, err)
+		}
+		var got []string
+		for _, q := range f.executed {
+			got = append(got, strings.Fields(q)[0])
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got executed statements %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "pgmig-changelog-test.json")
+	os.Remove(path)
+	defer os.Remove(path)
+
+	st, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore returned error %v", err)
+	}
+	m := mig.File{Ver: 7, FileName: "0007_Add_index.sql"}
+	if err := st.Insert(m); err != nil {
+		t.Fatalf("Insert returned error %v", err)
+	}
+	if err := st.Complete(context.Background(), nil, m.Ver, "app_owner", "work_mem=1GB"); err != nil {
+		t.Fatalf("Complete returned error %v", err)
+	}
+
+	st, err = NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore returned error %v on reload", err)
+	}
+	entries, _ := st.Entries()
+	if len(entries) != 1 || entries[0].FileName != m.FileName || !entries[0].State || entries[0].AppliedAs != "app_owner" || entries[0].Settings != "work_mem=1GB" {
+		t.Errorf("got entries %+v after reload", entries)
+	}
+	if last, _ := st.LastApplied(); last != 7 {
+		t.Errorf("got last applied version %d, want 7", last)
+	}
+}
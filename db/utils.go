@@ -1,15 +1,37 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"syscall"
 
+	"github.com/jackc/pgconn"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
-func buildConnString(host, port, database, username, password, sslmode string) string {
+// ErrorCode returns the SQLSTATE code of a database error (eg. "55P03"), or an empty string for other errors
+func ErrorCode(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// isLockTimeout checks if the error was caused by exceeding lock_timeout
+func isLockTimeout(err error) bool {
+	// 55P03 is lock_not_available
+	return ErrorCode(err) == "55P03"
+}
+
+func buildConnString(host, port, database, username, password, sslmode, schema string) string {
 	type param struct {
 		key   string
 		value string
@@ -34,6 +56,9 @@ func buildConnString(host, port, database, username, password, sslmode string) s
 	if sslmode != "" {
 		connStr += "sslmode=" + sslmode + " "
 	}
+	if schema != "" {
+		connStr += `search_path="` + sanitizeIdentifier(schema) + `",public `
+	}
 
 	return connStr
 }
@@ -54,6 +79,11 @@ func sanitizeIdentifier(identifier string) string {
 	return result
 }
 
+// quoteIdentifier quotes the name of a database object, doubling any double quotes in it
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
 func quoteString(value string) string {
 	return "'" + strings.Replace(value, "'", "''", -1) + "'"
 }
@@ -0,0 +1,225 @@
+// Package lint implements static analysis of migration files for operations
+// that take heavy locks or can cause outages.
+package lint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+// Rule describes a check performed by the linter
+type Rule struct {
+	ID          string
+	Description string
+}
+
+// Finding is a problem found by the linter in a migration file
+type Finding struct {
+	File      string `json:"file"`
+	Ver       int    `json:"version"`
+	Line      int    `json:"line"`
+	Rule      string `json:"rule"`
+	Message   string `json:"message"`
+	Statement string `json:"statement"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s:%d: [%s] %s", f.File, f.Line, f.Rule, f.Message)
+}
+
+// Rules lists all checks supported by the linter
+var Rules = []Rule{
+	{"create-index-not-concurrently", "CREATE INDEX without CONCURRENTLY on an existing table blocks writes"},
+	{"add-column-volatile-default", "ADD COLUMN with a volatile default rewrites the whole table"},
+	{"alter-column-type", "changing the type of a column usually rewrites the table under an exclusive lock"},
+	{"drop-column", "dropping a column breaks application code still using it"},
+	{"drop-table", "dropping a table breaks application code still using it"},
+	{"set-not-null", "SET NOT NULL without a validated check constraint scans the table under an exclusive lock"},
+	{"explicit-transaction", "explicit transaction control inside a migration that pgmig wraps in a transaction"},
+}
+
+var (
+	reCreateTable   = regexp.MustCompile(`^CREATE (?:(?:GLOBAL |LOCAL )?(?:TEMP |TEMPORARY )|UNLOGGED )?TABLE (?:IF NOT EXISTS )?([^\s(]+)`)
+	reCreateIndex   = regexp.MustCompile(`^CREATE (?:UNIQUE )?INDEX\b`)
+	reIndexTable    = regexp.MustCompile(`\bON (?:ONLY )?([^\s(]+)`)
+	reAlterTable    = regexp.MustCompile(`^ALTER TABLE (?:IF EXISTS )?(?:ONLY )?([^\s(]+) (.*)$`)
+	reAddColumn     = regexp.MustCompile(`^ADD (?:COLUMN )?(?:IF NOT EXISTS )?(\S+) (.*)$`)
+	reDefault       = regexp.MustCompile(`\bDEFAULT (.*)$`)
+	reVolatile      = regexp.MustCompile(`\b(?:RANDOM|CLOCK_TIMESTAMP|TIMEOFDAY|GEN_RANDOM_UUID|UUID_GENERATE_V[14][A-Z]*|NEXTVAL|TXID_CURRENT)\s*\(`)
+	reSerial        = regexp.MustCompile(`^(?:SMALL|BIG)?SERIAL\b`)
+	reAlterType     = regexp.MustCompile(`^ALTER (?:COLUMN )?(\S+) (?:SET DATA )?TYPE\b`)
+	reDropColumn    = regexp.MustCompile(`^DROP (?:COLUMN )?(?:IF EXISTS )?(\S+)`)
+	reSetNotNull    = regexp.MustCompile(`^ALTER (?:COLUMN )?(\S+) SET NOT NULL\b`)
+	reValidate      = regexp.MustCompile(`^VALIDATE CONSTRAINT\b`)
+	reDropTable     = regexp.MustCompile(`^DROP TABLE\b`)
+	reTransaction   = regexp.MustCompile(`^(?:BEGIN|START TRANSACTION|COMMIT|END|ROLLBACK|ABORT)\b`)
+	reNonColumnDrop = regexp.MustCompile(`^DROP (?:CONSTRAINT|DEFAULT|NOT NULL|EXPRESSION|IDENTITY)\b`)
+)
+
+// Linter checks migration files against a set of rules
+type Linter struct {
+	disabled map[string]bool
+	// tables created by the linted migrations, which are not yet used by applications
+	created map[string]bool
+	// tables with a validated check constraint, which allows SET NOT NULL without a table scan
+	validated map[string]bool
+	// noTransaction is set while linting a migration that pgmig does not wrap in a transaction
+	noTransaction bool
+}
+
+// New creates a new linter with all rules enabled
+func New() *Linter {
+	return &Linter{disabled: map[string]bool{}}
+}
+
+func findRule(id string) error {
+	for _, r := range Rules {
+		if r.ID == id {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown lint rule %s", id)
+}
+
+// Disable turns off the specified rules
+func (l *Linter) Disable(ids ...string) error {
+	for _, id := range ids {
+		if err := findRule(id); err != nil {
+			return err
+		}
+		l.disabled[id] = true
+	}
+	return nil
+}
+
+// EnableOnly turns off all rules, except the specified ones
+func (l *Linter) EnableOnly(ids ...string) error {
+	for _, id := range ids {
+		if err := findRule(id); err != nil {
+			return err
+		}
+	}
+	for _, r := range Rules {
+		l.disabled[r.ID] = true
+	}
+	for _, id := range ids {
+		delete(l.disabled, id)
+	}
+	return nil
+}
+
+// normalizeTable strips quotes and the default schema from a table name
+func normalizeTable(name string) string {
+	name = strings.ToLower(strings.Replace(name, `"`, "", -1))
+	return strings.TrimPrefix(name, "public.")
+}
+
+// splitActions splits the actions of an ALTER TABLE statement on top level commas
+func splitActions(actions string) []string {
+	var result []string
+	depth, start := 0, 0
+	for i, c := range actions {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				result = append(result, strings.TrimSpace(actions[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(result, strings.TrimSpace(actions[start:]))
+}
+
+// Lint checks the migration files in the order given and returns the problems found
+func (l *Linter) Lint(files []mig.File) ([]Finding, error) {
+	l.created = map[string]bool{}
+	l.validated = map[string]bool{}
+
+	var findings []Finding
+	for _, f := range files {
+		bytes, err := ioutil.ReadFile(f.Path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration file %s: %v", f.RelPath, err)
+		}
+		findings = append(findings, l.lintFile(f, string(bytes))...)
+	}
+	return findings, nil
+}
+
+func (l *Linter) lintFile(f mig.File, sql string) []Finding {
+	stmts, fileDisabled := split(sql)
+	l.noTransaction = f.Header.NoTransaction
+
+	var findings []Finding
+	for _, s := range stmts {
+		for _, p := range l.check(s) {
+			rule, msg := p[0], p[1]
+			if l.disabled[rule] || fileDisabled[rule] || fileDisabled["all"] || s.disabled[rule] || s.disabled["all"] {
+				continue
+			}
+			findings = append(findings, Finding{File: f.RelPath, Ver: f.Ver, Line: s.line, Rule: rule, Message: msg, Statement: s.text})
+		}
+	}
+	return findings
+}
+
+// check returns the rules violated by the statement as pairs of rule ID and message
+func (l *Linter) check(s *statement) [][2]string {
+	var problems [][2]string
+	add := func(rule, format string, args ...interface{}) {
+		problems = append(problems, [2]string{rule, fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case reCreateTable.MatchString(s.norm):
+		l.created[normalizeTable(reCreateTable.FindStringSubmatch(s.norm)[1])] = true
+
+	case reCreateIndex.MatchString(s.norm):
+		m := reIndexTable.FindStringSubmatch(s.norm)
+		if m != nil && !l.created[normalizeTable(m[1])] && !strings.Contains(s.norm, " CONCURRENTLY ") {
+			add("create-index-not-concurrently", "index on existing table %s should be created CONCURRENTLY", normalizeTable(m[1]))
+		}
+
+	case reAlterTable.MatchString(s.norm):
+		m := reAlterTable.FindStringSubmatch(s.norm)
+		table := normalizeTable(m[1])
+		for _, action := range splitActions(m[2]) {
+			if c := reAddColumn.FindStringSubmatch(action); c != nil && !strings.HasPrefix(action, "ADD CONSTRAINT ") {
+				if l.created[table] {
+					continue
+				}
+				if d := reDefault.FindStringSubmatch(c[2]); d != nil && reVolatile.MatchString(d[1]) {
+					add("add-column-volatile-default", "column %s is added to table %s with a volatile default", c[1], table)
+				} else if reSerial.MatchString(c[2]) {
+					add("add-column-volatile-default", "serial column %s is added to table %s", c[1], table)
+				}
+			} else if c := reAlterType.FindStringSubmatch(action); c != nil {
+				add("alter-column-type", "type of column %s in table %s is changed", c[1], table)
+			} else if c := reSetNotNull.FindStringSubmatch(action); c != nil {
+				if !l.created[table] && !l.validated[table] {
+					add("set-not-null", "column %s in table %s is set NOT NULL without a validated check constraint", c[1], table)
+				}
+			} else if reValidate.MatchString(action) {
+				l.validated[table] = true
+			} else if c := reDropColumn.FindStringSubmatch(action); c != nil && !reNonColumnDrop.MatchString(action) {
+				add("drop-column", "column %s is dropped from table %s", c[1], table)
+			}
+		}
+
+	case reDropTable.MatchString(s.norm):
+		add("drop-table", "table is dropped: %s", s.text)
+
+	case reTransaction.MatchString(s.norm) && !l.noTransaction:
+		add("explicit-transaction", "transaction control statement %s in a migration that runs in a transaction", strings.Fields(s.norm)[0])
+	}
+
+	return problems
+}
@@ -0,0 +1,77 @@
+package lint
+
+import (
+	"testing"
+
+	"github.com/quasoft/pgmig/mig"
+)
+
+func TestLintFile(t *testing.T) {
+	var tests = []struct {
+		sql  string
+		want []string
+	}{
+		{"CREATE INDEX idx_person_name ON person (name);", []string{"create-index-not-concurrently"}},
+		{"CREATE INDEX CONCURRENTLY idx_person_name ON person (name);", nil},
+		{"CREATE TABLE person (id int, name text);\nCREATE INDEX idx_person_name ON person (name);", nil},
+		{"ALTER TABLE person ADD COLUMN uid uuid DEFAULT gen_random_uuid();", []string{"add-column-volatile-default"}},
+		{"ALTER TABLE person ADD COLUMN active bool NOT NULL DEFAULT true;", nil},
+		{"ALTER TABLE person ADD COLUMN id bigserial;", []string{"add-column-volatile-default"}},
+		{"ALTER TABLE person ALTER COLUMN name TYPE varchar(100);", []string{"alter-column-type"}},
+		{"ALTER TABLE person DROP COLUMN name, DROP CONSTRAINT person_name_check;", []string{"drop-column"}},
+		{"ALTER TABLE person ALTER COLUMN name DROP DEFAULT;", nil},
+		{"DROP TABLE person;", []string{"drop-table"}},
+		{"ALTER TABLE person ALTER COLUMN name SET NOT NULL;", []string{"set-not-null"}},
+		{"ALTER TABLE person VALIDATE CONSTRAINT person_name_not_null;\nALTER TABLE person ALTER COLUMN name SET NOT NULL;", nil},
+		{"BEGIN;\nUPDATE person SET name = 'x';\nCOMMIT;", []string{"explicit-transaction", "explicit-transaction"}},
+		{"CREATE FUNCTION f() RETURNS void AS $$ BEGIN DROP TABLE person; END $$ LANGUAGE plpgsql;", nil},
+		{"UPDATE person SET note = 'DROP TABLE person; -- pgmig:lint-disable';", nil},
+		{"DROP TABLE person; -- pgmig:lint-disable drop-table", nil},
+		{"-- pgmig:lint-disable drop-table\nDROP TABLE person;\nDROP TABLE address;", []string{"drop-table"}},
+		{"-- pgmig:lint-disable-file\nDROP TABLE person;\nDROP TABLE address;", nil},
+		{"/* DROP TABLE person; */ SELECT 1;", nil},
+	}
+
+	for _, tt := range tests {
+		l := New()
+		l.created = map[string]bool{}
+		l.validated = map[string]bool{}
+		got := l.lintFile(mig.File{RelPath: "0001_Test.sql", Ver: 1}, tt.sql)
+		if len(got) != len(tt.want) {
+			t.Errorf("lintFile(%q): got %d findings %v, want %v", tt.sql, len(got), got, tt.want)
+			continue
+		}
+		for i, f := range got {
+			if f.Rule != tt.want[i] {
+				t.Errorf("lintFile(%q): got rule=%q, want rule=%q", tt.sql, f.Rule, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestLintNoTransaction(t *testing.T) {
+	l := New()
+	l.created = map[string]bool{}
+	l.validated = map[string]bool{}
+	f := mig.File{RelPath: "0001_Test.sql", Ver: 1, Header: mig.Header{NoTransaction: true}}
+	got := l.lintFile(f, "BEGIN;\nUPDATE person SET name = 'x';\nCOMMIT;")
+	if len(got) != 0 {
+		t.Errorf("lintFile: got %v, want no findings for a migration without transaction", got)
+	}
+}
+
+func TestDisable(t *testing.T) {
+	l := New()
+	if err := l.Disable("drop-table"); err != nil {
+		t.Fatalf("Disable(drop-table) returned error %v", err)
+	}
+	if err := l.Disable("no-such-rule"); err == nil {
+		t.Fatalf("Disable(no-such-rule) should have returned an error")
+	}
+	l.created = map[string]bool{}
+	l.validated = map[string]bool{}
+	got := l.lintFile(mig.File{RelPath: "0001_Test.sql", Ver: 1}, "DROP TABLE person;\nALTER TABLE address DROP COLUMN city;")
+	if len(got) != 1 || got[0].Rule != "drop-column" || got[0].Line != 2 {
+		t.Errorf("lintFile: got %v, want a single drop-column finding on line 2", got)
+	}
+}
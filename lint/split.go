@@ -0,0 +1,157 @@
+package lint
+
+import (
+	"regexp"
+	"strings"
+)
+
+// statement is a single SQL statement from a migration file
+type statement struct {
+	// text is the statement as written, without comments
+	text string
+	// norm is the statement in upper case, with collapsed whitespace and
+	// the contents of string literals and dollar-quoted bodies removed
+	norm string
+	// line is the number of the line on which the statement starts
+	line int
+	// disabled holds the rules suppressed for this statement with a "pgmig:lint-disable" comment
+	disabled map[string]bool
+}
+
+const (
+	directiveDisable     = "pgmig:lint-disable"
+	directiveDisableFile = "pgmig:lint-disable-file"
+)
+
+var dollarTag = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+var whitespace = regexp.MustCompile(`\s+`)
+
+// parseDirective parses a comment like "pgmig:lint-disable drop-table, drop-column" and
+// returns the directive and the list of rules it refers to
+func parseDirective(comment string) (string, []string) {
+	fields := strings.Fields(strings.Replace(comment, ",", " ", -1))
+	if len(fields) == 0 || (fields[0] != directiveDisable && fields[0] != directiveDisableFile) {
+		return "", nil
+	}
+	rules := fields[1:]
+	if len(rules) == 0 {
+		rules = []string{"all"}
+	}
+	return fields[0], rules
+}
+
+// split splits the SQL script into statements, removing comments and collecting
+// lint directives. Rules disabled for the whole file are returned separately.
+func split(sql string) ([]*statement, map[string]bool) {
+	var stmts []*statement
+	fileDisabled := map[string]bool{}
+	pending := map[string]bool{}
+
+	var text, norm strings.Builder
+	line, startLine, lastEndLine := 1, 0, 0
+
+	flush := func() {
+		t := strings.TrimSpace(text.String())
+		if t != "" {
+			n := strings.TrimSpace(whitespace.ReplaceAllString(norm.String(), " "))
+			stmts = append(stmts, &statement{text: t, norm: strings.ToUpper(n), line: startLine, disabled: pending})
+			pending = map[string]bool{}
+			lastEndLine = line
+		}
+		text.Reset()
+		norm.Reset()
+		startLine = 0
+	}
+	write := func(s string, normalized string) {
+		if startLine == 0 && strings.TrimSpace(s) != "" {
+			startLine = line
+		}
+		text.WriteString(s)
+		norm.WriteString(normalized)
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '\n':
+			write("\n", " ")
+			line++
+			i++
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			directive, rules := parseDirective(strings.TrimSpace(sql[i+2 : i+end]))
+			for _, r := range rules {
+				switch {
+				case directive == directiveDisableFile:
+					fileDisabled[r] = true
+				case lastEndLine == line && strings.TrimSpace(text.String()) == "" && len(stmts) > 0:
+					// Trailing comment on the same line as the end of the previous statement
+					stmts[len(stmts)-1].disabled[r] = true
+				default:
+					pending[r] = true
+				}
+			}
+			i += end
+		case strings.HasPrefix(sql[i:], "/*"):
+			depth, j := 0, i
+			for j < len(sql) {
+				if strings.HasPrefix(sql[j:], "/*") {
+					depth++
+					j += 2
+				} else if strings.HasPrefix(sql[j:], "*/") {
+					depth--
+					j += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					if sql[j] == '\n' {
+						line++
+					}
+					j++
+				}
+			}
+			write(" ", " ")
+			i = j
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(sql[i+1:], c)
+			if end < 0 {
+				end = len(sql) - i - 1
+			} else {
+				end++
+			}
+			literal := sql[i : i+end+1]
+			if c == '\'' {
+				write(literal, "''")
+			} else {
+				write(literal, literal)
+			}
+			line += strings.Count(literal, "\n")
+			i += end + 1
+		case c == '$' && dollarTag.MatchString(sql[i:]):
+			tag := dollarTag.FindString(sql[i:])
+			end := strings.Index(sql[i+len(tag):], tag)
+			if end < 0 {
+				end = len(sql) - i - len(tag)
+			} else {
+				end += 2 * len(tag)
+			}
+			literal := sql[i : i+end]
+			write(literal, "$$")
+			line += strings.Count(literal, "\n")
+			i += end
+		case c == ';':
+			flush()
+			i++
+		default:
+			write(string(c), string(c))
+			i++
+		}
+	}
+	flush()
+
+	return stmts, fileDisabled
+}
@@ -0,0 +1,175 @@
+// Package metrics collects gauges and counters and exposes them in the Prometheus text format,
+// either written to a file for the textfile collector of node_exporter or served over HTTP.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Labels are the label names and values of a sample, eg. {"database": "testdb"}
+type Labels map[string]string
+
+// Type is the Prometheus type of a metric
+type Type string
+
+// Supported metric types
+const (
+	Gauge   Type = "gauge"
+	Counter Type = "counter"
+)
+
+type family struct {
+	help    string
+	typ     Type
+	samples map[string]sample
+}
+
+type sample struct {
+	labels Labels
+	value  float64
+}
+
+// Registry holds the metrics of the process. It is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// New creates an empty registry
+func New() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// Register declares a metric with its help text and type. Metrics must be registered before
+// they are set.
+func (r *Registry) Register(name string, help string, typ Type) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[name]; !ok {
+		r.families[name] = &family{help: help, typ: typ, samples: map[string]sample{}}
+	}
+}
+
+// Set sets the value of the metric with the given labels
+func (r *Registry) Set(name string, labels Labels, value float64) {
+	r.update(name, labels, func(float64) float64 { return value })
+}
+
+// Add adds delta to the value of the metric with the given labels
+func (r *Registry) Add(name string, labels Labels, delta float64) {
+	r.update(name, labels, func(v float64) float64 { return v + delta })
+}
+
+func (r *Registry) update(name string, labels Labels, f func(float64) float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fam, ok := r.families[name]
+	if !ok {
+		panic(fmt.Sprintf("metric %s is not registered", name))
+	}
+	key := formatLabels(labels)
+	s := fam.samples[key]
+	s.labels = labels
+	s.value = f(s.value)
+	fam.samples[key] = s
+}
+
+// WriteTo writes all metrics in the Prometheus text format, sorted by name and labels
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var names []string
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fam := r.families[name]
+		if len(fam.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, escapeHelp(fam.help))
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, fam.typ)
+		var keys []string
+		for key := range fam.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&buf, "%s%s %s\n", name, key, strconv.FormatFloat(fam.samples[key].value, 'g', -1, 64))
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+// WriteFile writes all metrics to the file at the given path. The file is replaced atomically,
+// so that the textfile collector never reads a partially written file.
+func (r *Registry) WriteFile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not write metrics to %s: %v", path, err)
+	}
+	_, err = r.WriteTo(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not write metrics to %s: %v", path, err)
+	}
+	return nil
+}
+
+// ServeHTTP writes all metrics as the response, so that the registry can be scraped by Prometheus
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// formatLabels returns the labels in the Prometheus format, eg. `{changelog="changelog",database="testdb"}`
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var names []string
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeValue(labels[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var valueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeValue(s string) string {
+	return valueReplacer.Replace(s)
+}
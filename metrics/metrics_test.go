@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestRegistry() *Registry {
+	r := New()
+	r.Register("pgmig_pending_migrations", "Number of pending migrations", Gauge)
+	r.Register("pgmig_apply_errors_total", "Number of failed apply runs", Counter)
+	r.Register("pgmig_unused", "Metric without samples", Gauge)
+	r.Set("pgmig_pending_migrations", Labels{"database": "b", "changelog": "changelog"}, 3)
+	r.Set("pgmig_pending_migrations", Labels{"database": "a", "changelog": "changelog"}, 0)
+	r.Add("pgmig_apply_errors_total", Labels{"database": `we"ird\db`}, 1)
+	r.Add("pgmig_apply_errors_total", Labels{"database": `we"ird\db`}, 1)
+	return r
+}
+
+const wantMetrics = `# HELP pgmig_apply_errors_total Number of failed apply runs
+# TYPE pgmig_apply_errors_total counter
+pgmig_apply_errors_total{database="we\"ird\\db"} 2
+# HELP pgmig_pending_migrations Number of pending migrations
+# TYPE pgmig_pending_migrations gauge
+pgmig_pending_migrations{changelog="changelog",database="a"} 0
+pgmig_pending_migrations{changelog="changelog",database="b"} 3
+`
+
+func TestWriteTo(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := newTestRegistry().WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != wantMetrics {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), wantMetrics)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgmig-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pgmig.prom")
+	err = newTestRegistry().WriteFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != wantMetrics {
+		t.Errorf("got:\n%s\nwant:\n%s", got, wantMetrics)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("got %d files in directory, want only the metrics file", len(files))
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	srv := httptest.NewServer(newTestRegistry())
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, _ := ioutil.ReadAll(resp.Body)
+	if string(got) != wantMetrics {
+		t.Errorf("got:\n%s\nwant:\n%s", got, wantMetrics)
+	}
+}
@@ -3,7 +3,10 @@ package mig
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -12,15 +15,44 @@ import (
 // Dir represents an abstraction for listing migration files in a directory
 type Dir struct {
 	Path string
+	// Recursive enables scanning of nested directories (eg. "2025/", "release-4.2/").
+	// Hidden directories (eg. ".git") are skipped.
+	Recursive bool
+	// IncludeDirs lists glob patterns for subdirectories that take part in a recursive scan.
+	// Patterns are matched against the slash-separated path of the subdirectory, relative to Path.
+	// A subdirectory is included if it or any of its parents matches. If empty, all subdirectories
+	// are included. Files directly in Path are always included.
+	IncludeDirs []string
+	// ExcludeDirs lists glob patterns for subdirectories (and their children) to be skipped
+	// during a recursive scan. Exclude patterns take precedence over include patterns.
+	ExcludeDirs []string
+	// Include lists glob patterns for names of files to consider as migrations.
+	// If empty, DefaultInclude is used.
+	Include []string
+	// Exclude lists glob patterns for names of files to ignore, even if they match Include
+	Exclude []string
+	// Strict enables warnings about ignored files, whose names look like badly named migrations
+	Strict bool
+	// Warnings holds the warnings produced by the last call to Migrations
+	Warnings []string
 }
 
+// downSuffix ends the names of scripts reverting migrations, eg. "0001_Initial_db_structure.down.sql"
+const downSuffix = ".down.sql"
+
+// DefaultInclude are the patterns for names of migration files used if Dir.Include is empty
+var DefaultInclude = []string{"*.sql"}
+
+// looksLikeMigration matches names of files starting with a number, like "0012-add-index.sql" or "12 Add index.sql"
+var looksLikeMigration = regexp.MustCompile(`^[0-9]+`)
+
 // NewDir creates a new object for listing migration files in a directory
 func NewDir() *Dir {
 	return &Dir{}
 }
 
-// parseFileName parses file names in format "NNN_Title_with_underscores.sql" and
-// returns a mig.File structure with results.
+// parseFileName parses file names in format "NNN_Title_with_underscores.sql" or
+// "NNN_Title_with_underscores@context1,context2.sql" and returns a mig.File structure with results.
 func (d *Dir) parseFileName(fileName string) (*File, error) {
 	parts := strings.SplitN(fileName, "_", 2)
 	if len(parts) < 2 {
@@ -33,22 +65,111 @@ func (d *Dir) parseFileName(fileName string) (*File, error) {
 	m := NewFile(fileName, ver)
 	m.Title = strings.Replace(parts[1], "_", " ", -1)
 	m.Title = strings.TrimSuffix(m.Title, filepath.Ext(m.Title))
+	if i := strings.LastIndex(m.Title, "@"); i >= 0 {
+		m.Contexts = splitContexts(m.Title[i+1:])
+		m.Title = m.Title[:i]
+	}
 	return m, nil
 }
 
-// files returns names of all files found in the specified directory
+// matchAny checks if the relative path or any of its parents matches one of the glob patterns
+func matchAny(patterns []string, relPath string) bool {
+	for p := relPath; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchName checks if the file name matches one of the glob patterns
+func matchName(patterns []string, fileName string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, fileName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// includesFile checks if the file with the given name should be considered a migration
+func (d *Dir) includesFile(fileName string) bool {
+	include := d.Include
+	if len(include) == 0 {
+		include = DefaultInclude
+	}
+	return matchName(include, fileName) && !matchName(d.Exclude, fileName)
+}
+
+// ignore skips a file that is not a migration, warning about it in strict mode
+// if its name looks like a badly named migration.
+func (d *Dir) ignore(relPath string, reason string) {
+	if d.Strict && looksLikeMigration.MatchString(path.Base(relPath)) {
+		d.Warnings = append(d.Warnings, fmt.Sprintf("ignoring file %s, which looks like a migration: %s", relPath, reason))
+	}
+}
+
+// includesDir checks if files in the subdirectory with the given relative path take part in the scan
+func (d *Dir) includesDir(relPath string) bool {
+	if relPath == "." {
+		return true
+	}
+	if matchAny(d.ExcludeDirs, relPath) {
+		return false
+	}
+	return len(d.IncludeDirs) == 0 || matchAny(d.IncludeDirs, relPath)
+}
+
+// files returns the paths of all files found in the specified directory, relative to it.
+// Subdirectories are scanned only if Recursive is set.
 func (d *Dir) files() ([]string, error) {
-	entries, err := ioutil.ReadDir(d.Path)
-	if err != nil {
-		return nil, fmt.Errorf("could not list files %s: %v", d.Path, err)
+	root := d.Path
+	if root == "" {
+		root = "."
+	}
+
+	if !d.Recursive {
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			return nil, fmt.Errorf("could not list files %s: %v", d.Path, err)
+		}
+
+		var files []string
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			files = append(files, e.Name())
+		}
+		return files, nil
 	}
 
 	var files []string
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
 		}
-		files = append(files, e.Name())
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			// Hidden directories (eg. ".git" or ".squashed") are always skipped
+			if rel != "." && (strings.HasPrefix(info.Name(), ".") || matchAny(d.ExcludeDirs, rel)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.includesDir(path.Dir(rel)) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list files %s: %v", d.Path, err)
 	}
 
 	return files, nil
@@ -62,22 +183,63 @@ func (d *Dir) Migrations() ([]File, error) {
 		return nil, err
 	}
 
+	d.Warnings = nil
 	var migrations []File
+	downs := map[string]string{}
 	for _, f := range files {
-		m, err := d.parseFileName(f)
+		// Hook scripts are not versioned migrations
+		if isHook(f) {
+			continue
+		}
+		if !d.includesFile(path.Base(f)) {
+			d.ignore(f, "name does not match include/exclude patterns")
+			continue
+		}
+		// Down scripts are attached to the migration with the same name
+		if strings.HasSuffix(f, downSuffix) {
+			downs[strings.TrimSuffix(f, downSuffix)+".sql"] = f
+			continue
+		}
+		m, err := d.parseFileName(path.Base(f))
 		if err != nil {
-			return nil, err
+			d.ignore(f, err.Error())
+			continue
 		}
+		m.RelPath = f
 		// Check for migrations with duplicated version number
 		for _, mm := range migrations {
 			if mm.Ver == m.Ver {
-				return nil, fmt.Errorf("found migrations with the same version #%d:\r\n- %s\r\n- %s", m.Ver, mm.FileName, m.FileName)
+				return nil, fmt.Errorf("found migrations with the same version #%d: %s and %s", m.Ver, mm.RelPath, m.RelPath)
 			}
 		}
-		m.Path = filepath.Join(d.Path, m.FileName)
+		m.Path = filepath.Join(d.Path, filepath.FromSlash(m.RelPath))
+		m.Header, err = ReadHeader(m.Path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read header of migration file %s: %v", m.RelPath, err)
+		}
+		m.addContexts(m.Header.Contexts)
 		migrations = append(migrations, *m)
 	}
 
+	for i := range migrations {
+		if down, ok := downs[migrations[i].RelPath]; ok {
+			migrations[i].DownPath = filepath.Join(d.Path, filepath.FromSlash(down))
+			delete(downs, migrations[i].RelPath)
+		}
+	}
+	// Down scripts left without a migration (eg. after renaming it) are an error only in strict mode
+	orphans := []string{}
+	for _, down := range downs {
+		orphans = append(orphans, down)
+	}
+	sort.Strings(orphans)
+	for _, down := range orphans {
+		if d.Strict {
+			return nil, fmt.Errorf("down script %s has no matching migration", down)
+		}
+		d.Warnings = append(d.Warnings, fmt.Sprintf("ignoring down script %s, which has no matching migration", down))
+	}
+
 	sort.Slice(migrations, func(i, j int) bool {
 		return migrations[i].Ver < migrations[j].Ver
 	})
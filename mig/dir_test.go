@@ -1,6 +1,10 @@
 package mig
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -16,6 +20,7 @@ func TestParseFileName(t *testing.T) {
 		{"008.sql", File{}, false},
 		{"0016MigrationWithNoSeparator.sql", File{}, false},
 		{"0000_Migration_with_zero_version.sql", File{FileName: "0000_Migration_with_zero_version.sql", Ver: 0, Title: "Migration with zero version"}, true},
+		{"0005_Seed_demo_data@dev,ci.sql", File{FileName: "0005_Seed_demo_data@dev,ci.sql", Ver: 5, Title: "Seed demo data", Contexts: []string{"dev", "ci"}}, true},
 	}
 
 	dir := NewDir()
@@ -44,5 +49,205 @@ func TestParseFileName(t *testing.T) {
 		if got.Title != tt.want.Title {
 			t.Errorf("parseFileName(%s): got title=%q, want title=%q", tt.fileName, got.Title, tt.want.Title)
 		}
+		if strings.Join(got.Contexts, ",") != strings.Join(tt.want.Contexts, ",") {
+			t.Errorf("parseFileName(%s): got contexts=%v, want contexts=%v", tt.fileName, got.Contexts, tt.want.Contexts)
+		}
+	}
+}
+
+func TestMigrationsRecursive(t *testing.T) {
+	root, err := ioutil.TempDir("", "pgmig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, f := range []string{
+		"0001_Initial_db_structure.sql",
+		"2025/0002_Create_test_table.sql",
+		"2026/q1/0003_Add_index.sql",
+		"release-4.2/0004_Add_column.sql",
+		"archive/0001_Old_structure.sql",
+	} {
+		p := filepath.Join(root, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("SELECT 1;"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name    string
+		dir     Dir
+		want    []string
+		noError bool
+	}{
+		{"flat", Dir{Path: root}, []string{"0001_Initial_db_structure.sql"}, true},
+		{"duplicate version", Dir{Path: root, Recursive: true}, nil, false},
+		{"exclude", Dir{Path: root, Recursive: true, ExcludeDirs: []string{"archive"}},
+			[]string{"0001_Initial_db_structure.sql", "2025/0002_Create_test_table.sql", "2026/q1/0003_Add_index.sql", "release-4.2/0004_Add_column.sql"}, true},
+		{"include", Dir{Path: root, Recursive: true, IncludeDirs: []string{"2026", "release-*"}},
+			[]string{"0001_Initial_db_structure.sql", "2026/q1/0003_Add_index.sql", "release-4.2/0004_Add_column.sql"}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.dir.Migrations()
+		if err != nil {
+			if tt.noError {
+				t.Fatalf("%s: Migrations() returned error %v", tt.name, err)
+			}
+			continue
+		}
+		if !tt.noError {
+			t.Fatalf("%s: Migrations() should have returned an error", tt.name)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %d migrations, want %d", tt.name, len(got), len(tt.want))
+		}
+		for i, m := range got {
+			if m.RelPath != tt.want[i] {
+				t.Errorf("%s: got relpath=%q, want relpath=%q", tt.name, m.RelPath, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestMigrationsFiltering(t *testing.T) {
+	root, err := ioutil.TempDir("", "pgmig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, f := range []string{
+		"0001_Initial_db_structure.sql",
+		"0002_Create_test_table.sql",
+		"0003_Draft_changes.sql",
+		"README.md",
+		".gitkeep",
+		".0002_Create_test_table.sql.swp",
+		"migrate.sh",
+		"0012-add-index.sql",
+		"12 Add index.sql",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(root, f), []byte("SELECT 1;"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := Dir{Path: root, Exclude: []string{"*_Draft_*"}, Strict: true}
+	got, err := dir.Migrations()
+	if err != nil {
+		t.Fatalf("Migrations() returned error %v", err)
+	}
+	if len(got) != 2 || got[0].Ver != 1 || got[1].Ver != 2 {
+		t.Errorf("Migrations(): got %v, want versions 1 and 2", got)
+	}
+	// 0003_Draft_changes.sql, 0012-add-index.sql and 12 Add index.sql look like migrations
+	if len(dir.Warnings) != 3 {
+		t.Errorf("Migrations(): got %d warnings, want 3: %v", len(dir.Warnings), dir.Warnings)
+	}
+
+	dir.Strict = false
+	if _, err = dir.Migrations(); err != nil {
+		t.Fatalf("Migrations() returned error %v", err)
+	}
+	if len(dir.Warnings) != 0 {
+		t.Errorf("Migrations(): got %d warnings in non-strict mode, want 0", len(dir.Warnings))
+	}
+}
+
+func TestHooks(t *testing.T) {
+	root, err := ioutil.TempDir("", "pgmig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, f := range []string{"0001_Initial_db_structure.sql", "beforeAll.sql", "afterEach.sql", "afterError.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(root, f), []byte("SELECT 1;"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := Dir{Path: root, Include: []string{"*"}, Strict: true}
+	migrations, err := dir.Migrations()
+	if err != nil {
+		t.Fatalf("Migrations() returned error %v", err)
+	}
+	if len(migrations) != 1 {
+		t.Errorf("Migrations(): got %d migrations, want 1", len(migrations))
+	}
+
+	hooks, err := dir.Hooks()
+	if err != nil {
+		t.Fatalf("Hooks() returned error %v", err)
+	}
+	if len(hooks) != 2 || hooks[BeforeAll] == "" || hooks[AfterEach] == "" {
+		t.Errorf("Hooks(): got %v, want beforeAll and afterEach", hooks)
+	}
+}
+
+func TestMigrationsDown(t *testing.T) {
+	root, err := ioutil.TempDir("", "pgmig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, f := range []string{"0001_Initial_db_structure.sql", "0001_Initial_db_structure.down.sql", "0002_Create_test_table.sql"} {
+		if err := ioutil.WriteFile(filepath.Join(root, f), []byte("SELECT 1;"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := Dir{Path: root}
+	got, err := dir.Migrations()
+	if err != nil {
+		t.Fatalf("Migrations() returned error %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Migrations(): got %d migrations, want 2", len(got))
+	}
+	if got[0].DownPath != filepath.Join(root, "0001_Initial_db_structure.down.sql") {
+		t.Errorf("Migrations(): got downpath=%q for version 1", got[0].DownPath)
+	}
+	if got[1].DownPath != "" {
+		t.Errorf("Migrations(): got downpath=%q for version 2, want none", got[1].DownPath)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, "0003_Missing.down.sql"), []byte("SELECT 1;"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err = dir.Migrations()
+	if err != nil || len(got) != 2 || len(dir.Warnings) != 1 {
+		t.Errorf("Migrations(): got %d migrations, warnings %v, error %v; want 2 migrations and a warning for a down script without migration", len(got), dir.Warnings, err)
+	}
+	dir.Strict = true
+	if _, err := dir.Migrations(); err == nil {
+		t.Errorf("Migrations() should have returned an error for a down script without migration in strict mode")
+	}
+}
+
+func TestInContexts(t *testing.T) {
+	var tests = []struct {
+		contexts []string
+		selected []string
+		want     bool
+	}{
+		{nil, nil, true},
+		{nil, []string{"prod"}, true},
+		{[]string{"dev", "ci"}, nil, true},
+		{[]string{"dev", "ci"}, []string{"CI"}, true},
+		{[]string{"dev", "ci"}, []string{"staging", "prod"}, false},
+	}
+
+	for _, tt := range tests {
+		f := File{Contexts: tt.contexts}
+		if got := f.InContexts(tt.selected); got != tt.want {
+			t.Errorf("InContexts(%v) with contexts %v: got %v, want %v", tt.selected, tt.contexts, got, tt.want)
+		}
 	}
 }
@@ -1,14 +1,67 @@
 package mig
 
+import "strings"
+
 // File represents an SQL migration file with filename in format "0001_Initial_db_structure.sql"
 type File struct {
 	Ver      int
 	Title    string
 	FileName string
-	Path     string
+	// RelPath is the slash-separated path of the file, relative to the migrations directory
+	RelPath string
+	Path    string
+	// DownPath is the path to the script reverting the migration, if any (eg. "0001_Initial_db_structure.down.sql")
+	DownPath string
+	// Header holds the options declared in the leading comments of the file
+	Header Header
+	// Contexts lists the environments the migration is applied in, as declared in the file name
+	// (eg. "0005_Seed_demo_data@dev,ci.sql") or the header. Empty for migrations applied everywhere.
+	Contexts []string
 }
 
 // NewFile creates a new migration file object
 func NewFile(fileName string, ver int) *File {
-	return &File{Ver: ver, FileName: fileName}
+	return &File{Ver: ver, FileName: fileName, RelPath: fileName}
+}
+
+// InContexts checks if the migration should be applied when the given contexts are selected.
+// Migrations without contexts are applied everywhere, and all migrations are applied if no
+// contexts are selected.
+func (f *File) InContexts(selected []string) bool {
+	if len(selected) == 0 || len(f.Contexts) == 0 {
+		return true
+	}
+	for _, c := range f.Contexts {
+		for _, s := range selected {
+			if strings.EqualFold(c, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitContexts parses a comma separated list of contexts, eg. "dev, ci"
+func splitContexts(value string) []string {
+	var contexts []string
+	for _, c := range strings.Split(value, ",") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			contexts = append(contexts, c)
+		}
+	}
+	return contexts
+}
+
+// addContexts appends the contexts, which are not already listed
+func (f *File) addContexts(contexts []string) {
+	for _, c := range contexts {
+		found := false
+		for _, fc := range f.Contexts {
+			found = found || strings.EqualFold(fc, c)
+		}
+		if !found {
+			f.Contexts = append(f.Contexts, c)
+		}
+	}
 }
@@ -0,0 +1,152 @@
+package mig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// headerPrefix starts the directives in the leading comments of a migration file (eg. "-- pgmig:lock-timeout 5s")
+const headerPrefix = "pgmig:"
+
+// Header holds the options declared with "-- pgmig:<name> [value]" comments
+// at the beginning of a migration file.
+type Header struct {
+	// NoTransaction is set with "-- pgmig:no-transaction" for migrations that cannot run in a transaction
+	NoTransaction bool
+	// LockTimeout is set with "-- pgmig:lock-timeout <value>" and overrides the lock_timeout of the session
+	LockTimeout string
+	// StatementTimeout is set with "-- pgmig:statement-timeout <value>" and overrides the statement_timeout of the session
+	StatementTimeout string
+	// Retries is set with "-- pgmig:retries <n>" and overrides the number of retries on lock timeout
+	Retries *int
+	// ReplacesFrom and ReplacesTo are set with "-- pgmig:replaces <from>-<to>" in baseline migrations
+	// created by squashing the migrations with versions from..to
+	ReplacesFrom int
+	ReplacesTo   int
+	// Contexts is set with "-- pgmig:context <name>[,<name>...]" for migrations that should only
+	// be applied in some environments (eg. "dev,ci")
+	Contexts []string
+	// BatchSize is set with "-- pgmig:batch-size <n>" for data migrations, which are run repeatedly
+	// in committed batches of n rows, until they affect no rows. The ":batch_size" placeholder
+	// in the statement is replaced with n.
+	BatchSize int
+	// BatchEstimate is set with "-- pgmig:batch-estimate <query>" to a query returning the number
+	// of rows left to process by a batched migration, used to estimate the remaining time
+	BatchEstimate string
+	// Role is set with "-- pgmig:role <name>" and overrides the role the migration is applied as
+	Role string
+	// Settings are set with "-- pgmig:set <name>=<value>" (can be repeated) and override
+	// the run-time parameters of the session, eg. work_mem
+	Settings map[string]string
+}
+
+// parseHeader reads the directives from the leading comments of a migration file.
+// Reading stops at the first line that is neither empty nor a comment.
+func parseHeader(r io.Reader) (Header, error) {
+	var h Header
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		comment := strings.TrimSpace(strings.TrimPrefix(line, "--"))
+		if !strings.HasPrefix(comment, headerPrefix) {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(comment, headerPrefix))
+		if len(fields) == 0 {
+			return h, fmt.Errorf("empty directive %q", line)
+		}
+		name, value := fields[0], strings.Join(fields[1:], " ")
+		// Lint directives are handled by the linter
+		if strings.HasPrefix(name, "lint-") {
+			continue
+		}
+		if err := h.set(name, value); err != nil {
+			return h, err
+		}
+	}
+	return h, scanner.Err()
+}
+
+// set assigns the value of a single directive
+func (h *Header) set(name string, value string) error {
+	switch name {
+	case "no-transaction":
+		h.NoTransaction = true
+	case "lock-timeout":
+		h.LockTimeout = value
+	case "statement-timeout":
+		h.StatementTimeout = value
+	case "retries":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number of retries %q", value)
+		}
+		h.Retries = &n
+	case "batch-size":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid batch size %q", value)
+		}
+		h.BatchSize = n
+	case "batch-estimate":
+		h.BatchEstimate = value
+	case "context":
+		h.Contexts = splitContexts(value)
+	case "role":
+		h.Role = value
+	case "set":
+		if value == "" {
+			break
+		}
+		setting, val, err := ParseSetting(value)
+		if err != nil {
+			return err
+		}
+		if h.Settings == nil {
+			h.Settings = map[string]string{}
+		}
+		h.Settings[setting] = val
+	case "replaces":
+		var from, to int
+		_, err := fmt.Sscanf(value, "%d-%d", &from, &to)
+		if err != nil || from > to {
+			return fmt.Errorf("invalid range of replaced versions %q", value)
+		}
+		h.ReplacesFrom, h.ReplacesTo = from, to
+	default:
+		return fmt.Errorf("unknown directive %s", name)
+	}
+	if value == "" && name != "no-transaction" {
+		return fmt.Errorf("directive %s requires a value", name)
+	}
+	return nil
+}
+
+// ParseSetting splits a run-time parameter given as "name=value" into its name and value
+func ParseSetting(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+		return "", "", fmt.Errorf("invalid setting %q, expected name=value", s)
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
+}
+
+// ReadHeader reads the directives from the beginning of the migration file at the given path
+func ReadHeader(path string) (Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Header{}, err
+	}
+	defer f.Close()
+	return parseHeader(f)
+}
@@ -0,0 +1,59 @@
+package mig
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHeader(t *testing.T) {
+	var tests = []struct {
+		sql     string
+		want    Header
+		retries int
+		noError bool
+	}{
+		{"CREATE TABLE person (id int);", Header{}, -1, true},
+		{"-- Add index\n-- pgmig:no-transaction\n\nCREATE INDEX CONCURRENTLY i ON person (id);", Header{NoTransaction: true}, -1, true},
+		{"-- pgmig:lock-timeout 5s\n-- pgmig:statement-timeout 10min\n-- pgmig:retries 3\nSELECT 1;", Header{LockTimeout: "5s", StatementTimeout: "10min"}, 3, true},
+		{"-- pgmig:lint-disable-file drop-table\nDROP TABLE person;", Header{}, -1, true},
+		{"SELECT 1;\n-- pgmig:no-transaction", Header{}, -1, true},
+		{"-- pgmig:unknown\nSELECT 1;", Header{}, -1, false},
+		{"-- pgmig:lock-timeout\nSELECT 1;", Header{}, -1, false},
+		{"-- pgmig:retries many\nSELECT 1;", Header{}, -1, false},
+		{"-- pgmig:replaces 1-600\nSELECT 1;", Header{ReplacesFrom: 1, ReplacesTo: 600}, -1, true},
+		{"-- pgmig:replaces 600-1\nSELECT 1;", Header{}, -1, false},
+		{"-- pgmig:context dev, ci\nSELECT 1;", Header{Contexts: []string{"dev", "ci"}}, -1, true},
+		{"-- pgmig:context\nSELECT 1;", Header{}, -1, false},
+		{"-- pgmig:batch-size 5000\n-- pgmig:batch-estimate SELECT count(*) FROM person WHERE email IS NULL\nUPDATE person SET email = '';",
+			Header{BatchSize: 5000, BatchEstimate: "SELECT count(*) FROM person WHERE email IS NULL"}, -1, true},
+		{"-- pgmig:batch-size 0\nSELECT 1;", Header{}, -1, false},
+		{"-- pgmig:role app_owner\n-- pgmig:set work_mem=256MB\n-- pgmig:set search_path = app, public\nSELECT 1;",
+			Header{Role: "app_owner", Settings: map[string]string{"work_mem": "256MB", "search_path": "app, public"}}, -1, true},
+		{"-- pgmig:set work_mem\nSELECT 1;", Header{}, -1, false},
+		{"-- pgmig:role\nSELECT 1;", Header{}, -1, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseHeader(strings.NewReader(tt.sql))
+		if err != nil {
+			if tt.noError {
+				t.Fatalf("parseHeader(%q) returned error %v", tt.sql, err)
+			}
+			continue
+		}
+		if !tt.noError {
+			t.Fatalf("parseHeader(%q) should have returned an error", tt.sql)
+		}
+		if got.NoTransaction != tt.want.NoTransaction || got.LockTimeout != tt.want.LockTimeout || got.StatementTimeout != tt.want.StatementTimeout ||
+			got.ReplacesFrom != tt.want.ReplacesFrom || got.ReplacesTo != tt.want.ReplacesTo ||
+			strings.Join(got.Contexts, ",") != strings.Join(tt.want.Contexts, ",") ||
+			got.BatchSize != tt.want.BatchSize || got.BatchEstimate != tt.want.BatchEstimate ||
+			got.Role != tt.want.Role || !reflect.DeepEqual(got.Settings, tt.want.Settings) {
+			t.Errorf("parseHeader(%q): got %+v, want %+v", tt.sql, got, tt.want)
+		}
+		if (got.Retries == nil && tt.retries >= 0) || (got.Retries != nil && *got.Retries != tt.retries) {
+			t.Errorf("parseHeader(%q): got retries=%v, want retries=%d", tt.sql, got.Retries, tt.retries)
+		}
+	}
+}
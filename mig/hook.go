@@ -0,0 +1,51 @@
+package mig
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Names of hook scripts, which are run at specific points of an apply run.
+// A hook is stored in the root of the migrations directory in a file named after it (eg. "afterAll.sql").
+const (
+	BeforeAll  = "beforeAll"
+	BeforeEach = "beforeEach"
+	AfterEach  = "afterEach"
+	AfterAll   = "afterAll"
+	AfterError = "afterError"
+)
+
+// HookNames lists the names of all supported hooks
+var HookNames = []string{BeforeAll, BeforeEach, AfterEach, AfterAll, AfterError}
+
+// hookExt is the extension of hook script files
+const hookExt = ".sql"
+
+// isHook checks if the file with the given path, relative to the migrations directory, is a hook script
+func isHook(relPath string) bool {
+	for _, name := range HookNames {
+		if relPath == name+hookExt {
+			return true
+		}
+	}
+	return false
+}
+
+// Hooks returns the paths to the hook scripts found in the directory, by hook name
+func (d *Dir) Hooks() (map[string]string, error) {
+	hooks := map[string]string{}
+	for _, name := range HookNames {
+		p := filepath.Join(d.Path, name+hookExt)
+		info, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			hooks[name] = p
+		}
+	}
+	return hooks, nil
+}
@@ -0,0 +1,141 @@
+package mig
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultArchiveDir is the directory, relative to the migrations directory, to which squashed migrations are moved.
+// It is hidden, so its files are not scanned as migrations.
+const DefaultArchiveDir = ".squashed"
+
+// squashedDirective matches the "-- pgmig:" prefix of directives in squashed files
+var squashedDirective = regexp.MustCompile(`(?m)^(\s*--\s*)` + headerPrefix)
+
+// Squash replaces all migrations with versions up to and including the given one with a single baseline
+// migration, whose content is the concatenation of the replaced files. The baseline gets the version of the
+// last replaced migration and records the range of replaced versions in a "-- pgmig:replaces" directive,
+// so databases that already applied them treat it as applied. The replaced files and their down scripts
+// are moved to archiveDir, relative to the migrations directory. Migrations which cannot run in the single
+// transaction of the baseline, or which set their own role or settings, cannot be squashed.
+func (d *Dir) Squash(through int, archiveDir string) (*File, error) {
+	migrations, err := d.Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var squashed []File
+	for _, m := range migrations {
+		if m.Ver <= through {
+			squashed = append(squashed, m)
+		}
+	}
+	if len(squashed) == 0 {
+		return nil, fmt.Errorf("there are no migrations with version up to %d", through)
+	}
+	first, last := squashed[0], squashed[len(squashed)-1]
+
+	from := first.Ver
+	if first.Header.ReplacesTo > 0 {
+		from = first.Header.ReplacesFrom
+	}
+
+	for _, m := range squashed {
+		// The baseline is applied in all environments
+		if len(m.Contexts) > 0 {
+			return nil, fmt.Errorf("cannot squash migration %s, which is only applied in contexts %s", m.RelPath, strings.Join(m.Contexts, ","))
+		}
+		if m.Header.BatchSize > 0 {
+			return nil, fmt.Errorf("cannot squash batched migration %s", m.RelPath)
+		}
+		// The baseline is applied in a single transaction, as the session user and with the session settings
+		if m.Header.NoTransaction {
+			return nil, fmt.Errorf("cannot squash migration %s, which cannot run in a transaction", m.RelPath)
+		}
+		if m.Header.Role != "" || len(m.Header.Settings) > 0 || m.Header.LockTimeout != "" || m.Header.StatementTimeout != "" {
+			return nil, fmt.Errorf("cannot squash migration %s, which sets its own role or settings", m.RelPath)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "-- %sreplaces %d-%d\n", headerPrefix, from, last.Ver)
+	fmt.Fprintf(&buf, "--\n-- Baseline created by squashing %d migrations:\n", len(squashed))
+	for _, m := range squashed {
+		fmt.Fprintf(&buf, "-- - %s\n", m.RelPath)
+	}
+	for _, m := range squashed {
+		content, err := ioutil.ReadFile(m.Path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration file %s: %v", m.RelPath, err)
+		}
+		// Directives of the squashed files must not become part of the header of the baseline
+		content = squashedDirective.ReplaceAll(content, []byte("${1}squashed "+headerPrefix))
+		fmt.Fprintf(&buf, "\n-- Squashed from %s\n%s\n", m.RelPath, strings.TrimRight(string(content), "\n"))
+	}
+
+	// Keep the number of digits used for versions in file names
+	digits := strings.SplitN(last.FileName, "_", 2)[0]
+	baseline := NewFile(digits+"_Baseline.sql", last.Ver)
+	baseline.Title = "Baseline"
+	baseline.Path = filepath.Join(d.Path, baseline.FileName)
+	baseline.Header = Header{ReplacesFrom: from, ReplacesTo: last.Ver}
+	if _, err := os.Stat(baseline.Path); err == nil {
+		return nil, fmt.Errorf("baseline file %s already exists", baseline.Path)
+	}
+
+	// Write the baseline before archiving the replaced files, so that they are not lost if writing fails
+	err = writeFile(baseline.Path, buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("could not write baseline file %s: %v", baseline.Path, err)
+	}
+
+	// Move replaced files to the archive
+	archive := filepath.Join(d.Path, archiveDir)
+	for _, m := range squashed {
+		paths := []string{m.Path}
+		if m.DownPath != "" {
+			paths = append(paths, m.DownPath)
+		}
+		for _, p := range paths {
+			rel, err := filepath.Rel(d.Path, p)
+			if err != nil {
+				return nil, err
+			}
+			dest := filepath.Join(archive, rel)
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return nil, fmt.Errorf("could not create archive directory: %v", err)
+			}
+			if err := os.Rename(p, dest); err != nil {
+				return nil, fmt.Errorf("could not archive %s: %v", rel, err)
+			}
+		}
+	}
+	return baseline, nil
+}
+
+// writeFile writes the data to a temporary file, which then replaces the file at path
+func writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
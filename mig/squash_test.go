@@ -0,0 +1,134 @@
+package mig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSquash(t *testing.T) {
+	root, err := ioutil.TempDir("", "pgmig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, f := range []string{
+		"0001_Initial_db_structure.sql",
+		"0002_Create_test_table.sql",
+		"0002_Create_test_table.down.sql",
+		"0003_Add_index.sql",
+	} {
+		content := "SELECT " + f[3:4] + ";\n"
+		if f == "0001_Initial_db_structure.sql" {
+			content = "-- pgmig:retries 5\n" + content
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, f), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := Dir{Path: root}
+	baseline, err := dir.Squash(2, DefaultArchiveDir)
+	if err != nil {
+		t.Fatalf("Squash(2) returned error %v", err)
+	}
+	if baseline.FileName != "0002_Baseline.sql" || baseline.Ver != 2 {
+		t.Errorf("Squash(2): got baseline %s with version %d, want 0002_Baseline.sql with version 2", baseline.FileName, baseline.Ver)
+	}
+
+	got, err := dir.Migrations()
+	if err != nil {
+		t.Fatalf("Migrations() returned error %v", err)
+	}
+	if len(got) != 2 || got[0].FileName != "0002_Baseline.sql" || got[1].Ver != 3 {
+		t.Fatalf("Migrations(): got %v, want baseline and version 3", got)
+	}
+	if got[0].Header.ReplacesFrom != 1 || got[0].Header.ReplacesTo != 2 {
+		t.Errorf("Migrations(): got baseline replacing %d-%d, want 1-2", got[0].Header.ReplacesFrom, got[0].Header.ReplacesTo)
+	}
+
+	content, err := ioutil.ReadFile(baseline.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-- pgmig:replaces 1-2\n--\n-- Baseline created by squashing 2 migrations:\n-- - 0001_Initial_db_structure.sql\n-- - 0002_Create_test_table.sql\n" +
+		"\n-- Squashed from 0001_Initial_db_structure.sql\n-- squashed pgmig:retries 5\nSELECT 1;\n" +
+		"\n-- Squashed from 0002_Create_test_table.sql\nSELECT 2;\n"
+	if string(content) != want {
+		t.Errorf("Squash(2): got content %q, want %q", content, want)
+	}
+
+	for _, f := range []string{"0001_Initial_db_structure.sql", "0002_Create_test_table.sql", "0002_Create_test_table.down.sql"} {
+		if _, err := os.Stat(filepath.Join(root, DefaultArchiveDir, f)); err != nil {
+			t.Errorf("Squash(2): %s was not archived: %v", f, err)
+		}
+	}
+
+	// Squashing again includes the range replaced by the previous baseline
+	baseline, err = dir.Squash(3, DefaultArchiveDir)
+	if err != nil {
+		t.Fatalf("Squash(3) returned error %v", err)
+	}
+	if baseline.Header.ReplacesFrom != 1 || baseline.Header.ReplacesTo != 3 {
+		t.Errorf("Squash(3): got baseline replacing %d-%d, want 1-3", baseline.Header.ReplacesFrom, baseline.Header.ReplacesTo)
+	}
+
+	// Directives of the squashed files, including the previous baseline, do not leak into the header
+	header, err := ReadHeader(baseline.Path)
+	if err != nil {
+		t.Fatalf("ReadHeader(%s) returned error %v", baseline.FileName, err)
+	}
+	if header.ReplacesFrom != 1 || header.ReplacesTo != 3 || header.Retries != nil {
+		t.Errorf("ReadHeader(%s): got %+v, want only replaces 1-3", baseline.FileName, header)
+	}
+	got, err = dir.Migrations()
+	if err != nil {
+		t.Fatalf("Migrations() returned error %v", err)
+	}
+	if len(got) != 1 || got[0].Header.ReplacesFrom != 1 || got[0].Header.ReplacesTo != 3 {
+		t.Errorf("Migrations(): got %+v, want a single baseline replacing 1-3", got)
+	}
+}
+
+func TestSquashRefused(t *testing.T) {
+	var tests = []struct {
+		name   string
+		header string
+	}{
+		{"no transaction", "-- pgmig:no-transaction\n"},
+		{"role", "-- pgmig:role app_owner\n"},
+		{"settings", "-- pgmig:set work_mem=1GB\n"},
+		{"lock timeout", "-- pgmig:lock-timeout 5s\n"},
+		{"statement timeout", "-- pgmig:statement-timeout 1min\n"},
+		{"contexts", "-- pgmig:context dev\n"},
+		{"batched", "-- pgmig:batch-size 1000\n"},
+	}
+	for _, tt := range tests {
+		root, err := ioutil.TempDir("", "pgmig")
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string]string{
+			"0001_Initial_db_structure.sql": "SELECT 1;\n",
+			"0002_Create_test_table.sql":    tt.header + "SELECT 2;\n",
+		}
+		for f, content := range files {
+			if err := ioutil.WriteFile(filepath.Join(root, f), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dir := Dir{Path: root}
+		if _, err := dir.Squash(2, DefaultArchiveDir); err == nil {
+			t.Errorf("%s: Squash(2) should have returned an error", tt.name)
+		}
+		// Nothing is written or archived
+		got, err := dir.Migrations()
+		if err != nil || len(got) != 2 || got[1].FileName != "0002_Create_test_table.sql" {
+			t.Errorf("%s: Migrations(): got %v, %v; want the original files", tt.name, got, err)
+		}
+		os.RemoveAll(root)
+	}
+}
@@ -0,0 +1,138 @@
+// Package notify sends the results of apply runs to webhooks and local commands.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Event is the point of an apply run, at which a notification is sent
+type Event string
+
+// Supported events
+const (
+	Start   Event = "start"
+	Success Event = "success"
+	Failure Event = "failure"
+)
+
+// Migration describes a migration applied during the run
+type Migration struct {
+	Version int    `json:"version"`
+	File    string `json:"file"`
+	// DurationMs is the time it took to apply the migration, in milliseconds
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// Payload is the JSON document sent with each notification
+type Payload struct {
+	Event  Event     `json:"event"`
+	Target string    `json:"target"`
+	Time   time.Time `json:"time"`
+	// Pending lists the versions of the migrations to apply (only for the start event)
+	Pending []int `json:"pending,omitempty"`
+	// Applied lists the migrations applied successfully so far
+	Applied []Migration `json:"applied"`
+	// FailedAt is the version of the migration that failed, if any
+	FailedAt int    `json:"failed_at,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Notifier sends notifications
+type Notifier interface {
+	Notify(p Payload) error
+}
+
+// Webhook posts the payload as JSON to a URL, retrying if the request fails
+// or the response status is not 2xx
+type Webhook struct {
+	URL string
+	// Retries is the number of times a failed request is retried
+	Retries int
+	// RetryDelay is the delay before the first retry, doubled on each subsequent retry
+	RetryDelay time.Duration
+	Client     *http.Client
+}
+
+// NewWebhook creates a webhook notifier for the URL with 3 retries and a 10 second request timeout
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		URL:        url,
+		Retries:    3,
+		RetryDelay: time.Second,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify posts the payload to the URL of the webhook
+func (w *Webhook) Notify(p Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("could not encode notification: %v", err)
+	}
+
+	delay := w.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil || attempt >= w.Retries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (w *Webhook) post(body []byte) error {
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The error of the client repeats the URL
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("could not send notification to %s: %v", w.host(), err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("could not send notification to %s: %s", w.host(), resp.Status)
+	}
+	return nil
+}
+
+// host returns the scheme and host of the URL for errors, as webhooks often carry a secret
+// in the path or query string
+func (w *Webhook) host() string {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Host == "" {
+		return "webhook"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// Command runs a shell command with the payload as JSON on its standard input
+type Command struct {
+	Command string
+}
+
+// Notify runs the command and waits for it to finish
+func (c *Command) Notify(p Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("could not encode notification: %v", err)
+	}
+
+	cmd := exec.Command("sh", "-c", c.Command)
+	cmd.Stdin = bytes.NewReader(body)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("notification command %q failed: %v: %s", c.Command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var testPayload = Payload{
+	Event:    Failure,
+	Target:   "localhost:5432/testdb",
+	Applied:  []Migration{{Version: 1, File: "0001_Init.sql", DurationMs: 12}},
+	FailedAt: 2,
+	Error:    "relation \"person\" does not exist",
+}
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	var got Payload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		// Fail the first request, to check that it is retried
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("got content type %s, want application/json", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("could not decode payload: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(srv.URL)
+	w.RetryDelay = 0
+	err := w.Notify(testPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+	if got.Event != Failure || got.Target != testPayload.Target || got.FailedAt != 2 || len(got.Applied) != 1 || got.Error != testPayload.Error {
+		t.Errorf("got payload %+v, want %+v", got, testPayload)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(srv.URL + "/services/T000/secret-path?token=secret-token")
+	w.Retries = 2
+	w.RetryDelay = 0
+	err := w.Notify(testPayload)
+	if err == nil {
+		t.Fatal("Notify should have returned an error")
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error %q should not contain the path and query of the URL", err)
+	}
+
+	// Connection errors do not repeat the URL either
+	srv.Close()
+	w.Retries = 0
+	err = w.Notify(testPayload)
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("got error %v, want an error without the path and query of the URL", err)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgmig-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "payload.json")
+	c := &Command{Command: "cat > " + path}
+	err = c.Notify(testPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Payload
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Event != Failure || got.FailedAt != 2 {
+		t.Errorf("got payload %+v, want %+v", got, testPayload)
+	}
+
+	err = (&Command{Command: "exit 3"}).Notify(testPayload)
+	if err == nil {
+		t.Error("Notify should have returned an error for a failing command")
+	}
+}